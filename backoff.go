@@ -0,0 +1,76 @@
+// Copyright 2015 Felipe A. Cavani. All rights reserved.
+// Use of this source code is governed by the Apache License 2.0
+// license that can be found in the LICENSE file.
+
+package discover
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Backoff gives the time that the client waits before try again.
+type Backoff interface {
+	// Next returns the wait before the attempt number attempt, starting
+	// from one, prev is the previous wait.
+	Next(attempt int, prev time.Duration) time.Duration
+}
+
+// ExponentialBackoff doubles the wait in each attempt, starting in Base and
+// up to Max. If Jitter is true the wait is a random value between zero and
+// the exponential wait.
+type ExponentialBackoff struct {
+	Base   time.Duration
+	Max    time.Duration
+	Jitter bool
+}
+
+func (b *ExponentialBackoff) Next(attempt int, prev time.Duration) time.Duration {
+	wait := b.Base
+	for i := 1; i < attempt; i++ {
+		if b.Max > 0 && wait >= b.Max {
+			break
+		}
+		if wait > maxDuration/2 {
+			wait = maxDuration
+			break
+		}
+		wait *= 2
+	}
+	wait = capDuration(wait, b.Max)
+	if b.Jitter && wait > 0 {
+		wait = time.Duration(rand.Int63n(int64(wait) + 1))
+	}
+	return wait
+}
+
+// DecorrelatedJitter waits a random time between Base and three times the
+// previous wait, up to Max.
+type DecorrelatedJitter struct {
+	Base time.Duration
+	Max  time.Duration
+}
+
+func (b *DecorrelatedJitter) Next(attempt int, prev time.Duration) time.Duration {
+	if prev < b.Base {
+		prev = b.Base
+	}
+	top := prev * 3
+	if top < prev {
+		top = maxDuration
+	}
+	wait := b.Base
+	if top > b.Base {
+		wait += time.Duration(rand.Int63n(int64(top - b.Base)))
+	}
+	return capDuration(wait, b.Max)
+}
+
+const maxDuration = time.Duration(1<<63 - 1)
+
+func capDuration(d, max time.Duration) time.Duration {
+	if max > 0 && d > max {
+		return max
+	}
+	return d
+}
@@ -11,7 +11,7 @@ import (
 	"encoding/gob"
 	"net"
 	"strconv"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/fcavani/e"
@@ -33,9 +33,17 @@ type Client struct {
 	Timeout time.Duration
 	// Deadline is the udp io deadline
 	Deadline time.Duration
-	// Keepalive is the periode of the keepalive package
+	// Backoff gives the wait between the attempts to contact the server.
+	// If it is nil the client tries again immediately.
+	Backoff Backoff
+	// MaxAttempts is the maximum number of attempts to contact the server,
+	// zero means no limit other than Timeout.
+	MaxAttempts int
+	// Keepalive is the periode of the keepalive package proposed to the server.
+	// After the discovery it holds the periode negotiated with the server.
 	Keepalive time.Duration
 	// Request function returns the data that will be send to the server.
+	// The addresses are probed in parallel, but the calls are serialized.
 	Request    func(dst *net.UDPAddr) (*Request, error)
 	ServerName string
 	//ServerKey is the server public key
@@ -43,10 +51,60 @@ type Client struct {
 	// Name is the name of this client. This is used to pick the right public key.
 	Name       string
 	PrivateKey *rsa.PrivateKey
+	// GroupKey is the pre-shared key of the group. If it is set it is used
+	// instead of PrivateKey and ServerKey.
+	GroupKey []byte
+	// Open sends the requests without authentication to a server in open
+	// mode. If ServerKey is set the responses must be signed by the server.
+	Open bool
 	// Id is the unique identification for this client
-	Id     string
-	stopKa chan chan struct{}
-	conn   *net.UDPConn
+	Id string
+	// OnShutdown is called when the server notifies that it is closing.
+	// Successor is the address of the server that replaces it, if any.
+	OnShutdown func(successor string)
+	// Supervise makes the client discover the server again when the
+	// session is lost, keeping the same Id.
+	Supervise bool
+	// Servers are other servers tried, in order, by the supervised client
+	// when it can't find the current server.
+	Servers []ServerInfo
+	// OnState is called when the state of the client changes.
+	OnState func(state State)
+	// OnKeepAlive is called after each keepalive with the round trip time
+	// or the error, if the keepalive failed.
+	OnKeepAlive func(rtt time.Duration, err error)
+	// AllInterfaces makes the client probe all interfaces that are up,
+	// not only Interface.
+	AllInterfaces bool
+	// ProbeDelay is the delay between the start of the probes of each
+	// address, so the first addresses are preferred if they answer fast.
+	// Zero starts all probes at once.
+	ProbeDelay time.Duration
+	// AllSubnets makes the client look for the server in the directed
+	// broadcast of every IPv4 subnet of the interface, not only in the
+	// subnet of the address that it sends from. One probe is made for
+	// each subnet.
+	AllSubnets bool
+	// Seeds are the addresses, or host names, where the server is
+	// contacted directly, for the networks without multicast or broadcast.
+	// They are probed together with the interfaces. If the port is omitted
+	// Port is used.
+	Seeds []string
+	// SeedsOnly makes the client contact only the Seeds.
+	SeedsOnly bool
+	state     State
+	seq       uint16
+	stopKa    chan chan struct{}
+	kaDone    chan struct{}
+	replies   chan reply
+	conn      *net.UDPConn
+	dst       *net.UDPAddr
+	cookies   map[*net.UDPConn][]byte
+	closed    chan struct{}
+	lck       sync.Mutex
+	// lckRequest serializes the calls to Request.
+	lckRequest sync.Mutex
+	wg         sync.WaitGroup
 }
 
 // Discover funtion discovers the server and returns the data sent by the server.
@@ -74,45 +132,26 @@ func (c *Client) Discover() (*Response, error) {
 		}
 	}
 	c.stopKa = make(chan chan struct{})
+	c.cookies = make(map[*net.UDPConn][]byte)
+	c.closed = make(chan struct{})
 	c.InitMCast()
-	err = c.getInt()
-	if err != nil {
-		return nil, e.Forward(err)
+	if !c.SeedsOnly {
+		err = c.getInt()
+		if err != nil {
+			return nil, e.Forward(err)
+		}
 	}
+	c.setState(Discovering)
 	resp, err := c.getAddr()
 	if err != nil {
+		c.setState(Lost)
 		return nil, e.Forward(err)
 	}
 	return resp, nil
 }
 
-func (c *Client) getAddr() (*Response, error) {
-	addrs, err := c.iface.Addrs()
-	if err != nil {
-		return nil, e.New(err)
-	}
-	for _, addr := range addrs {
-		a := addr.String()
-		i := strings.Index(a, "/")
-		if i != -1 {
-			a = a[:i]
-		}
-		if !c.AddrAllowed(a) {
-			continue
-		}
-		resp, err := c.client(a)
-		if e.Equal(err, ErrCantFindInt) {
-			continue
-		} else if err != nil {
-			return nil, e.Forward(err)
-		}
-		return resp, nil
-	}
-	return nil, e.New("no addresses capable for listen udp")
-}
-
-func (c *Client) encode(typ msgType, val interface{}, dst *net.UDPAddr) error {
-	log.ProtoLevel().Tag("client", "discover").Printf("Send request (%v) to %v from %v.", typ, dst, c.conn.LocalAddr())
+func (c *Client) encode(conn *net.UDPConn, typ msgType, val interface{}, dst *net.UDPAddr) error {
+	log.ProtoLevel().Tag("client", "discover").Printf("Send request (%v) to %v from %v.", typ, dst, conn.LocalAddr())
 
 	reqBuf := bytes.NewBuffer([]byte{})
 
@@ -132,10 +171,11 @@ func (c *Client) encode(typ msgType, val interface{}, dst *net.UDPAddr) error {
 		return e.Push(err, e.New("error encoding"))
 	}
 
-	msg, err := NewMsg(c.Name, c.ServerName, c.PrivateKey, c.ServerKey, reqBuf.Bytes())
+	msg, err := c.seal(reqBuf.Bytes())
 	if err != nil {
 		return e.Push(err, "erro cryptographing the value")
 	}
+	msg.Cookie = c.cookie(conn)
 
 	reqBuf = bytes.NewBuffer([]byte{})
 	enc = gob.NewEncoder(reqBuf)
@@ -147,41 +187,46 @@ func (c *Client) encode(typ msgType, val interface{}, dst *net.UDPAddr) error {
 	if reqBuf.Len() > c.BufSize {
 		return e.New("value to encode is too big %v", reqBuf.Len())
 	}
-	err = c.conn.SetDeadline(time.Now().Add(c.Deadline))
+	err = conn.SetWriteDeadline(time.Now().Add(c.Deadline))
 	if err != nil {
 		return e.New(err)
 	}
-	_, _, err = c.conn.WriteMsgUDP(reqBuf.Bytes(), nil, dst)
+	_, _, err = conn.WriteMsgUDP(reqBuf.Bytes(), nil, dst)
 	if err != nil {
 		return e.New(err)
 	}
-	err = c.conn.SetDeadline(time.Time{})
+	err = conn.SetWriteDeadline(time.Time{})
 	if err != nil {
 		return e.New(err)
 	}
 	return nil
 }
 
-func (c *Client) response() (*Response, error) {
+func (c *Client) response(conn *net.UDPConn) (*Response, error) {
 	log.ProtoLevel().Tag("client", "discover").Printf("Waiting response...")
 	buf := make([]byte, c.BufSize)
-	err := c.conn.SetDeadline(time.Now().Add(c.Deadline))
+	err := conn.SetReadDeadline(time.Now().Add(c.Deadline))
 	if err != nil {
 		return nil, e.New(err)
 	}
-	n, addr, err := c.conn.ReadFromUDP(buf)
+	n, addr, err := conn.ReadFromUDP(buf)
 	if err != nil {
 		return nil, e.New(err)
 	}
 	log.ProtoLevel().Tag("client", "discover").Printf("Response from %v with size %v.", addr, n)
-	err = c.conn.SetDeadline(time.Time{})
+	err = conn.SetReadDeadline(time.Time{})
 	if err != nil {
 		return nil, e.New(err)
 	}
+	return c.decode(conn, buf[:n])
+}
 
-	dec := gob.NewDecoder(bytes.NewReader(buf[:n]))
+// decode decodes, verifies and decrypts a response from the server received
+// in conn.
+func (c *Client) decode(conn *net.UDPConn, buf []byte) (*Response, error) {
+	dec := gob.NewDecoder(bytes.NewReader(buf))
 	var msg Msg
-	err = dec.Decode(&msg)
+	err := dec.Decode(&msg)
 	if err != nil {
 		return nil, e.Push(err, e.New("error decoding response"))
 	}
@@ -197,7 +242,14 @@ func (c *Client) response() (*Response, error) {
 		return nil, e.New("message isn't for me")
 	}
 
-	buf, err = msg.Message(c.ServerKey, c.PrivateKey)
+	if len(msg.Cookie) > 0 && len(msg.Data) == 0 {
+		c.lck.Lock()
+		c.cookies[conn] = msg.Cookie
+		c.lck.Unlock()
+		return nil, e.New(ErrCookie)
+	}
+
+	buf, err = c.open(&msg)
 	if err != nil {
 		return nil, e.Push(err, e.New("error decrypting response"))
 	}
@@ -211,86 +263,152 @@ func (c *Client) response() (*Response, error) {
 	return &resp, nil
 }
 
-const ErrCantFindInt = "can't find an interface with the right capabilites"
+// reply is a response or an error received from the server.
+type reply struct {
+	resp *Response
+	err  error
+}
 
-func (c *Client) client(addr string) (*Response, error) {
-	ip, err := ipport(c.Interface, addr, "0")
-	if err != nil {
-		return nil, e.Push(err, ErrCantFindInt)
-	}
-	client, err := net.ResolveUDPAddr("udp", ip)
-	if err != nil {
-		return nil, e.Push(err, ErrCantFindInt)
-	}
-	c.conn, err = net.ListenUDP("udp", client)
-	if err != nil {
-		return nil, e.Push(err, ErrCantFindInt)
-	}
-	var dst *net.UDPAddr
-	if c.iface.Flags&net.FlagLoopback == net.FlagLoopback {
-		ip, err := ipport(c.Interface, addr, c.Port)
-		if err != nil {
-			return nil, e.Push(err, ErrCantFindInt)
+// recv reads the messages sent by the server after the discovery and
+// delivers them in replies. Replies is closed when the connection is closed.
+func (c *Client) recv(conn *net.UDPConn, replies chan<- reply) {
+	defer close(replies)
+	for {
+		buf := make([]byte, c.BufSize)
+		n, addr, err := conn.ReadFromUDP(buf)
+		if e.Contains(err, "use of closed network connection") {
+			return
+		} else if err != nil {
+			log.Tag("client", "discover").Errorf("ReadFromUDP (%v) failed: %v", addr, err)
+			continue
 		}
-		dst, err = net.ResolveUDPAddr("udp", ip)
-		if err != nil {
-			return nil, e.Push(err, ErrCantFindInt)
+		log.ProtoLevel().Tag("client", "discover").Printf("Message from %v with size %v.", addr, n)
+		resp, err := c.decode(conn, buf[:n])
+		select {
+		case replies <- reply{resp: resp, err: err}:
+		default:
+			log.Tag("client", "discover").Errorf("Message from %v dropped.", addr)
 		}
-	} else if !c.NotMulticast && c.iface.Flags&net.FlagMulticast == net.FlagMulticast {
-		dst, err = c.multicast(c.conn.LocalAddr())
-		if err != nil {
-			return nil, e.Push(err, ErrCantFindInt)
+	}
+}
+
+// wait waits for the next reply delivered by recv.
+func (c *Client) wait(replies <-chan reply) (*Response, error) {
+	select {
+	case r, ok := <-replies:
+		if !ok {
+			return nil, e.New("connection closed")
 		}
-	} else if c.iface.Flags&net.FlagBroadcast == net.FlagBroadcast {
-		dst, err = broadcast(c.conn.LocalAddr(), c.Port)
-		if err != nil {
-			return nil, e.Push(err, ErrCantFindInt)
+		return r.resp, r.err
+	case <-time.After(c.Deadline):
+		return nil, e.New("i/o timeout")
+	case <-c.closed:
+		return nil, e.New(ErrClientClosed)
+	}
+}
+
+// current returns true if the response is of the current session, and not
+// of other client or an old session.
+func (c *Client) current(resp *Response) bool {
+	return resp.Id == c.Id && resp.Seq == c.seq
+}
+
+// shutdown handles the notice from the server that it is closing.
+func (c *Client) shutdown(dst *net.UDPAddr, resp *Response) {
+	log.Tag("client", "discover").Printf("Server %v is closing. Successor: %v", dst, resp.Successor)
+	if c.OnShutdown != nil {
+		c.OnShutdown(resp.Successor)
+	}
+	c.lost(resp.Successor)
+}
+
+// seal creates a message to the server with the keys configured in the client.
+func (c *Client) seal(data []byte) (*Msg, error) {
+	if c.Open {
+		return NewPlainMsg(c.Name, c.ServerName, data), nil
+	}
+	if len(c.GroupKey) > 0 {
+		return NewGroupMsg(c.Name, c.ServerName, c.GroupKey, data)
+	}
+	return NewMsg(c.Name, c.ServerName, c.PrivateKey, c.ServerKey, data)
+}
+
+// open verifies and decrypts a message from the server. The message must
+// be in the same mode used by the client.
+func (c *Client) open(msg *Msg) ([]byte, error) {
+	if c.Open && c.ServerKey != nil {
+		return msg.SignedMessage(c.ServerKey)
+	} else if c.Open {
+		if msg.Mode == SignedMode && len(msg.Data) == 1 {
+			return msg.Data[0], nil
 		}
-	} else {
-		return nil, e.Push(e.New("interface isn't suported: %v", c.iface.Flags), ErrCantFindInt)
+		return msg.PlainMessage()
+	}
+	if len(c.GroupKey) > 0 {
+		return msg.GroupMessage(c.GroupKey)
 	}
-	log.ProtoLevel().Tag("discover", "client").Printf("Local ip %v.", c.conn.LocalAddr())
+	if msg.Mode != RsaMode {
+		return nil, e.New("message isn't in rsa mode")
+	}
+	return msg.Message(c.ServerKey, c.PrivateKey)
+}
+
+const ErrCantFindInt = "can't find an interface with the right capabilites"
+
+const ErrClientClosed = "client closed"
+
+// handshake contacts the server in dst with the connection conn. If claim
+// isn't nil it is called when the server answers, the handshake gives up
+// if claim returns false.
+func (c *Client) handshake(conn *net.UDPConn, dst *net.UDPAddr, claim func() bool) (*Response, error) {
+	log.ProtoLevel().Tag("discover", "client").Printf("Local ip %v.", conn.LocalAddr())
 	log.ProtoLevel().Tag("discover", "client").Printf("Try to contact server in %v.", dst)
 	now := time.Now()
 	end := now.Add(c.Timeout)
-	for d := now; d.Before(end) || d.Equal(end); d = time.Now() {
+	var wait time.Duration
+	for attempt, d := 0, now; d.Before(end) || d.Equal(end); attempt, d = attempt+1, time.Now() {
+		if c.MaxAttempts > 0 && attempt >= c.MaxAttempts {
+			break
+		}
+		if attempt > 0 && c.Backoff != nil {
+			wait = c.Backoff.Next(attempt, wait)
+			if left := end.Sub(d); wait > left {
+				wait = left
+			}
+			log.ProtoLevel().Tag("discover", "client").Printf("Wait %v before try again.", wait)
+		}
+		select {
+		case <-c.closed:
+			return nil, e.New(ErrClientClosed)
+		case <-time.After(wait):
+		}
+
+		c.lckRequest.Lock()
 		req, err := c.Request(dst)
+		c.lckRequest.Unlock()
 		if err != nil {
 			return nil, e.Forward(err)
 		}
 
 		req.Id = c.Id
-		req.Ip = c.conn.LocalAddr().String()
+		req.Ip = conn.LocalAddr().String()
+		req.Keepalive = c.Keepalive
 
-		err = c.encode(protoReq, req, dst)
+		resp, err := c.roundTrip(conn, protoReq, req, dst, c.response)
 		if e.Contains(err, "i/o timeout") {
-			log.Errorf("Error %v -> %v: %v", c.conn.LocalAddr(), dst, err)
+			log.Errorf("Error %v -> %v: %v", conn.LocalAddr(), dst, err)
 			continue
 		} else if err != nil {
 			return nil, e.Forward(err)
 		}
 
-		resp, err := c.response()
-		if e.Contains(err, "i/o timeout") {
-			log.Errorf("Error %v -> %v: %v", c.conn.LocalAddr(), dst, err)
-			continue
-		} else if err != nil {
-			return nil, e.Forward(err)
+		if claim != nil && !claim() {
+			return nil, e.New(ErrProbeLost)
 		}
 
-		c.Id = resp.Id
-
-		err = c.encode(protoConfirm, resp.Id, dst)
+		rp, err := c.roundTrip(conn, protoConfirm, resp.Id, dst, c.response)
 		if e.Contains(err, "i/o timeout") {
-			log.Errorf("Error %v -> %v: %v", c.conn.LocalAddr(), dst, err)
-			continue
-		} else if err != nil {
-			return nil, e.Forward(err)
-		}
-
-		rp, err := c.response()
-		if e.Contains(err, "i/o timeout") {
-			log.Errorf("Error %v -> %v: %v", c.conn.LocalAddr(), dst, err)
+			log.Errorf("Error %v -> %v: %v", conn.LocalAddr(), dst, err)
 			continue
 		} else if err != nil {
 			return nil, e.Forward(err)
@@ -300,28 +418,47 @@ func (c *Client) client(addr string) (*Response, error) {
 			return nil, e.New("protocol fail wrong response")
 		}
 
-		go func(dst *net.UDPAddr) {
-			for {
-				select {
-				case <-time.After(c.Keepalive):
-					log.ProtoLevel().Tag("client", "discover").Printf("Send keep alive to %v", dst)
-					err := c.keepalive(dst)
-					if err != nil {
-						log.Tag("client", "discover").Errorf("Keep alive to %v failed: %v", dst, err)
-						return
-					}
-				case ch := <-c.stopKa:
-					ch <- struct{}{}
-					return
-				}
-			}
-		}(dst)
-
 		return resp, nil
 	}
 	return nil, e.New("can't find the server")
 }
 
+// start adopts the session in resp, made with the server in dst through
+// conn, and starts the keepalives.
+func (c *Client) start(conn *net.UDPConn, dst *net.UDPAddr, resp *Response) {
+	c.Id = resp.Id
+	c.seq = resp.Seq
+	if resp.Keepalive > 0 {
+		c.Keepalive = resp.Keepalive
+	}
+	replies := make(chan reply, 10)
+	done := make(chan struct{})
+	c.lck.Lock()
+	c.conn = conn
+	c.dst = dst
+	c.replies = replies
+	c.kaDone = done
+	c.lck.Unlock()
+	go c.recv(conn, replies)
+	go c.keep(conn, dst, resp.Timeout, replies, done)
+	c.setState(Connected)
+}
+
+// cookie returns the cookie given by the server to the connection.
+func (c *Client) cookie(conn *net.UDPConn) []byte {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	return c.cookies[conn]
+}
+
+// closeConn closes the connection and forgets its cookie.
+func (c *Client) closeConn(conn *net.UDPConn) error {
+	c.lck.Lock()
+	delete(c.cookies, conn)
+	c.lck.Unlock()
+	return conn.Close()
+}
+
 func ipport(in, ip, port string) (string, error) {
 	if utilNet.IsValidIpv4(ip) {
 		return ip + ":" + port, nil
@@ -332,7 +469,10 @@ func ipport(in, ip, port string) (string, error) {
 	}
 }
 
-func broadcast(addr net.Addr, port string) (*net.UDPAddr, error) {
+// broadcast returns the directed broadcast address of the subnet of addr
+// in the interface, or the limited broadcast if the subnet has none. IPv6
+// has no broadcast, the link-local all nodes group is used instead.
+func broadcast(iface *net.Interface, addr net.Addr, port string) (*net.UDPAddr, error) {
 	p, err := strconv.ParseInt(port, 10, 32)
 	if err != nil {
 		return nil, e.New(err)
@@ -344,15 +484,80 @@ func broadcast(addr net.Addr, port string) (*net.UDPAddr, error) {
 	}
 	if utilNet.IsValidIpv4(a.IP.String()) {
 		udpAddr.IP = net.IPv4bcast
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, e.New(err)
+		}
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok || !ipnet.IP.Equal(a.IP) {
+				continue
+			}
+			if bcast := directed(ipnet); bcast != nil {
+				udpAddr.IP = bcast
+			}
+			break
+		}
 	} else if utilNet.IsValidIpv6(a.IP.String()) {
+		// The group is link-local, it must leave by the interface even
+		// if the source address is global.
 		udpAddr.IP = net.IPv6linklocalallnodes
-		udpAddr.Zone = a.Zone
+		udpAddr.Zone = iface.Name
 	} else {
 		return nil, e.New("invalid ip address")
 	}
 	return udpAddr, nil
 }
 
+// directed returns the directed broadcast address of the IPv4 subnet, or
+// nil if it doesn't have one.
+func directed(ipnet *net.IPNet) net.IP {
+	ip := ipnet.IP.To4()
+	if ip == nil {
+		return nil
+	}
+	mask := ipnet.Mask
+	if len(mask) == net.IPv6len {
+		mask = mask[12:]
+	}
+	if ones, bits := mask.Size(); bits != 32 || ones > 30 {
+		return nil
+	}
+	bcast := make(net.IP, net.IPv4len)
+	for i := range ip {
+		bcast[i] = ip[i] | ^mask[i]
+	}
+	return bcast
+}
+
+// subnets returns the directed broadcast addresses of all IPv4 subnets of
+// the interface.
+func subnets(iface *net.Interface) ([]net.IP, error) {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, e.New(err)
+	}
+	var bcasts []net.IP
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		bcast := directed(ipnet)
+		if bcast == nil {
+			continue
+		}
+		dup := false
+		for _, b := range bcasts {
+			dup = dup || b.Equal(bcast)
+		}
+		if !dup {
+			bcasts = append(bcasts, bcast)
+		}
+	}
+	return bcasts, nil
+}
+
 func (c *Client) multicast(addr net.Addr) (*net.UDPAddr, error) {
 	host, _, err := utilNet.SplitHostPort(addr.String())
 	if err != nil {
@@ -375,21 +580,138 @@ func (c *Client) multicast(addr net.Addr) (*net.UDPAddr, error) {
 	}
 }
 
-func (c *Client) keepalive(dst *net.UDPAddr) error {
-	err := c.encode(protoKeepAlive, c.Id, dst)
+// keep sends the keepalives to the server until the client is closed or
+// the session is lost.
+func (c *Client) keep(conn *net.UDPConn, dst *net.UDPAddr, timeout time.Duration, replies <-chan reply, done chan struct{}) {
+	defer close(done)
+	last := time.Now()
+	degraded := false
+	for {
+		select {
+		case <-time.After(c.Keepalive):
+			log.ProtoLevel().Tag("client", "discover").Printf("Send keep alive to %v", dst)
+			start := time.Now()
+			resp, err := c.keepalive(conn, dst, replies)
+			if e.Equal(err, ErrClientClosed) {
+				// Close is waiting to stop the keepalives.
+				continue
+			}
+			if c.OnKeepAlive != nil {
+				c.OnKeepAlive(time.Since(start), err)
+			}
+			if e.Contains(err, "i/o timeout") && time.Since(last) < timeout {
+				log.Tag("client", "discover").Errorf("Keep alive to %v failed: %v", dst, err)
+				if !degraded {
+					degraded = true
+					c.setState(Degraded)
+				}
+				continue
+			} else if err != nil {
+				log.Tag("client", "discover").Errorf("Keep alive to %v failed, giving up: %v", dst, err)
+				c.lost("")
+				return
+			}
+			last = time.Now()
+			if degraded {
+				degraded = false
+				c.setState(Connected)
+			}
+			if resp.Closing && c.current(resp) {
+				c.shutdown(dst, resp)
+				return
+			}
+		case r, ok := <-replies:
+			if !ok {
+				return
+			} else if r.err != nil {
+				log.Tag("client", "discover").Errorf("Invalid message from %v: %v", dst, r.err)
+				continue
+			}
+			if r.resp.Closing && c.current(r.resp) {
+				c.shutdown(dst, r.resp)
+				return
+			}
+		case ch := <-c.stopKa:
+			ch <- struct{}{}
+			return
+		}
+	}
+}
+
+func (c *Client) keepalive(conn *net.UDPConn, dst *net.UDPAddr, replies <-chan reply) (*Response, error) {
+	resp, err := c.roundTrip(conn, protoKeepAlive, c.Id, dst, func(*net.UDPConn) (*Response, error) {
+		return c.wait(replies)
+	})
 	if err != nil {
-		return e.Forward(err)
+		return nil, e.Forward(err)
 	}
-	_, err = c.response()
+	return resp, nil
+}
+
+// leave tells the server that the client is leaving. The reply isn't
+// waited, if the message is lost the session expires.
+func (c *Client) leave(conn *net.UDPConn, dst *net.UDPAddr) error {
+	err := c.encode(conn, protoLeave, &leaveMsg{Id: c.Id, Seq: c.seq}, dst)
 	if err != nil {
 		return e.Forward(err)
 	}
 	return nil
 }
 
+// roundTrip sends the message and receives the response with recv. If the
+// server answers with a cookie challenge the message is sent again, now
+// with the cookie.
+func (c *Client) roundTrip(conn *net.UDPConn, typ msgType, val interface{}, dst *net.UDPAddr, recv func(conn *net.UDPConn) (*Response, error)) (*Response, error) {
+	for i := 0; ; i++ {
+		err := c.encode(conn, typ, val, dst)
+		if err != nil {
+			return nil, e.Forward(err)
+		}
+		resp, err := recv(conn)
+		if e.Contains(err, ErrCookie) && i == 0 {
+			log.ProtoLevel().Tag("client", "discover").Printf("Cookie received from %v.", dst)
+			continue
+		} else if err != nil {
+			return nil, e.Forward(err)
+		}
+		return resp, nil
+	}
+}
+
+// Close stops the supervisor and the keepalives and tells the server that
+// the client is leaving.
 func (c *Client) Close() error {
-	ch := make(chan struct{})
-	c.stopKa <- ch
-	<-ch
-	return e.New(c.conn.Close())
+	c.lck.Lock()
+	select {
+	case <-c.closed:
+	default:
+		close(c.closed)
+	}
+	c.lck.Unlock()
+	c.wg.Wait()
+
+	c.lck.Lock()
+	done, dst, conn := c.kaDone, c.dst, c.conn
+	c.lck.Unlock()
+
+	alive := false
+	if done != nil {
+		ch := make(chan struct{})
+		select {
+		case c.stopKa <- ch:
+			<-ch
+			alive = true
+		case <-done:
+		}
+	}
+	if alive {
+		err := c.leave(conn, dst)
+		if err != nil {
+			log.Tag("client", "discover").Errorf("Leave message to %v failed: %v", dst, err)
+		}
+	}
+	if conn == nil {
+		return nil
+	}
+	return e.New(c.closeConn(conn))
 }
@@ -6,6 +6,7 @@ package discover
 
 import (
 	"net"
+	"time"
 
 	"github.com/fcavani/e"
 	utilNet "github.com/fcavani/net"
@@ -14,6 +15,24 @@ import (
 type MulticastAddr struct {
 	McIpv4 string
 	McIpv6 string
+	// McTTL is the TTL, or the hop limit in IPv6, of the multicast
+	// packets. Zero keeps the system default, one, that doesn't cross
+	// routers. Only the client probes are multicast, the server answers
+	// with unicast, so McTTL, McNoLoop and McInterface are ignored by the
+	// server.
+	McTTL int
+	// McNoLoop stops the multicast packets sent from being delivered
+	// back to this host.
+	McNoLoop bool
+	// McInterface is the name of the interface where the multicast
+	// packets leave. Default is the interface of the socket.
+	McInterface string
+	// McSources are the addresses of the designated sources of a
+	// source-specific group (IGMPv3/MLDv2). If they are set the server
+	// receives only the packets sent by them, and the clients send only
+	// from their addresses that are in the list. The group should be in
+	// 232.0.0.0/8 or ff3x::/96.
+	McSources []string
 }
 
 func (m *MulticastAddr) InitMCast() {
@@ -91,19 +110,27 @@ func (a AddrVer) Proto() string {
 }
 
 // Request is sent by the client and contains the client
-// ip and a payload.
+// ip, the keepalive interval proposed by the client and a payload.
 type Request struct {
-	Ip   string
-	Id   string
-	Data []byte
+	Ip        string
+	Id        string
+	Keepalive time.Duration
+	Data      []byte
 }
 
 // Response is sent by the server to the client with
-// a id, a sequence number, incoming order of the client, the ip address of the server
-// and a payload.
+// a id, a sequence number, incoming order of the client, the ip address of the server,
+// the keepalive interval that the client must use, the time without keepalives
+// after that the session expires and a payload.
+// When the server is closing it sends one response with Closing set and the
+// address of its successor, if any.
 type Response struct {
-	Id   string
-	Seq  uint16
-	Ip   string
-	Data []byte
+	Id        string
+	Seq       uint16
+	Ip        string
+	Keepalive time.Duration
+	Timeout   time.Duration
+	Closing   bool
+	Successor string
+	Data      []byte
 }
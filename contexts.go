@@ -12,39 +12,111 @@ import (
 	"github.com/fcavani/e"
 )
 
-type context struct {
-	Ttl  time.Time
-	Id   string
-	Seq  uint16
+// Session is a snapshot of the state of one client in the server.
+type Session struct {
+	// Id is the unique identification of the client
+	Id string
+	// Seq is the incoming order of the client
+	Seq uint16
+	// Addr is the client address
 	Addr *net.UDPAddr
+	// Name is the client name
+	Name string
+	// Interface is the name of the interface where the client was found
+	Interface string
+	// LastSeen is the time of the last message received from the client
+	LastSeen time.Time
+	// Keepalive is the keepalive interval negotiated with the client
+	Keepalive time.Duration
+	// Ttl is the time when the session expires if the keepalives stop
+	// arriving in the negotiated interval. The failure detector may expire
+	// the session later, if the arrivals are irregular.
+	Ttl time.Time
+	// Phi is the suspicion level that the client is dead. The session
+	// expires when it reaches the server PhiThreshold.
+	Phi float64
+}
+
+type context struct {
+	Ttl       time.Time
+	LastSeen  time.Time
+	Id        string
+	Seq       uint16
+	Addr      *net.UDPAddr
+	Name      string
+	Keepalive time.Duration
+	Timeout   time.Duration
+	Mode      MsgMode
+	Interface string
+	detector  *phi
+}
+
+func (c *context) session() *Session {
+	return &Session{
+		Id:        c.Id,
+		Seq:       c.Seq,
+		Addr:      c.Addr,
+		Name:      c.Name,
+		Interface: c.Interface,
+		LastSeen:  c.LastSeen,
+		Keepalive: c.Keepalive,
+		Ttl:       c.Ttl,
+		Phi:       c.detector.Phi(time.Now()),
+	}
+}
+
+// response creates a response with the session data.
+func (c *context) response() *Response {
+	return &Response{
+		Id:        c.Id,
+		Ip:        c.Addr.String(),
+		Seq:       c.Seq,
+		Keepalive: c.Keepalive,
+		Timeout:   c.Timeout,
+	}
 }
 
 type contexts struct {
-	ctxs     map[string]*context
-	duration time.Duration
-	lck      sync.RWMutex
-	chclose  chan chan struct{}
+	ctxs    map[string]*context
+	lck     sync.RWMutex
+	chclose chan chan struct{}
 }
 
-func newContexts(duration, interval time.Duration) *contexts {
+// newContexts creates the contexts store. Each interval the contexts with
+// the suspicion level above threshold are removed and expired is called for
+// each one of them.
+func newContexts(interval time.Duration, threshold float64, expired func(ctx *context)) *contexts {
 	c := &contexts{
-		ctxs:     make(map[string]*context),
-		duration: duration,
-		chclose:  make(chan chan struct{}),
+		ctxs:    make(map[string]*context),
+		chclose: make(chan chan struct{}),
 	}
 	go func() {
 		for {
 			select {
 			case <-time.After(interval):
+				old := make([]*context, 0)
 				c.lck.Lock()
+				now := time.Now()
 				for id, ctx := range c.ctxs {
-					if time.Now().After(ctx.Ttl) {
+					if ctx.detector.Phi(now) >= threshold {
 						delete(c.ctxs, id)
+						old = append(old, ctx)
 					}
 				}
 				c.lck.Unlock()
+				if expired == nil || len(old) == 0 {
+					continue
+				}
+				// The callbacks may close the contexts, so they can't
+				// block this goroutine.
+				go func() {
+					for _, ctx := range old {
+						expired(ctx)
+					}
+				}()
 			case ch := <-c.chclose:
 				ch <- struct{}{}
+				return
 			}
 		}
 	}()
@@ -66,30 +138,108 @@ func (c *contexts) Register(ctx *context) error {
 	if found {
 		return e.New(ErrCtxAlreadyRegistered)
 	}
-	c.ctxs[ctx.Id] = ctx
+	ctx.LastSeen = time.Now()
+	ctx.Ttl = ctx.LastSeen.Add(ctx.Timeout)
+	ctx.detector = newPhi(ctx.Keepalive, ctx.Timeout-ctx.Keepalive)
+	cp := *ctx
+	c.ctxs[ctx.Id] = &cp
 	return nil
 }
 
 const ErrCtxNotFound = "context not found"
 
-func (c *contexts) Del(id string) error {
+// Del removes the context and returns it.
+func (c *contexts) Del(id string) (*context, error) {
 	c.lck.Lock()
 	defer c.lck.Unlock()
-	_, found := c.ctxs[id]
+	ctx, found := c.ctxs[id]
 	if !found {
-		return e.New(ErrCtxNotFound)
+		return nil, e.New(ErrCtxNotFound)
 	}
 	delete(c.ctxs, id)
-	return nil
+	return ctx, nil
 }
 
+// Get returns a copy of the context and renews its ttl.
 func (c *contexts) Get(id string) (*context, error) {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	ctx, found := c.ctxs[id]
+	if !found {
+		return nil, e.New(ErrCtxNotFound)
+	}
+	ctx.LastSeen = time.Now()
+	ctx.Ttl = ctx.LastSeen.Add(ctx.Timeout)
+	cp := *ctx
+	return &cp, nil
+}
+
+// Move renews the context like Get and moves it to the address where the
+// client is now. The client may confirm the session from other address
+// than the one of the request.
+func (c *contexts) Move(id string, addr *net.UDPAddr, intface string) (*context, error) {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	ctx, found := c.ctxs[id]
+	if !found {
+		return nil, e.New(ErrCtxNotFound)
+	}
+	ctx.Addr = addr
+	ctx.Interface = intface
+	ctx.LastSeen = time.Now()
+	ctx.Ttl = ctx.LastSeen.Add(ctx.Timeout)
+	cp := *ctx
+	return &cp, nil
+}
+
+// KeepAlive renews the context like Get and feeds the failure detector
+// with the arrival of the keepalive.
+func (c *contexts) KeepAlive(id string) (*context, error) {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	ctx, found := c.ctxs[id]
+	if !found {
+		return nil, e.New(ErrCtxNotFound)
+	}
+	ctx.LastSeen = time.Now()
+	ctx.Ttl = ctx.LastSeen.Add(ctx.Timeout)
+	ctx.detector.Heartbeat(ctx.LastSeen)
+	cp := *ctx
+	return &cp, nil
+}
+
+// Peek returns a copy of the context without renew it.
+func (c *contexts) Peek(id string) (*context, error) {
 	c.lck.RLock()
 	defer c.lck.RUnlock()
 	ctx, found := c.ctxs[id]
 	if !found {
 		return nil, e.New(ErrCtxNotFound)
 	}
-	ctx.Ttl = time.Now().Add(c.duration)
-	return ctx, nil
+	cp := *ctx
+	return &cp, nil
+}
+
+// All returns a copy of all contexts.
+func (c *contexts) All() []*context {
+	c.lck.RLock()
+	defer c.lck.RUnlock()
+	all := make([]*context, 0, len(c.ctxs))
+	for _, ctx := range c.ctxs {
+		cp := *ctx
+		all = append(all, &cp)
+	}
+	return all
+}
+
+// Clear removes all contexts and returns them.
+func (c *contexts) Clear() []*context {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	all := make([]*context, 0, len(c.ctxs))
+	for _, ctx := range c.ctxs {
+		all = append(all, ctx)
+	}
+	c.ctxs = make(map[string]*context)
+	return all
 }
@@ -0,0 +1,98 @@
+// Copyright 2015 Felipe A. Cavani. All rights reserved.
+// Use of this source code is governed by the Apache License 2.0
+// license that can be found in the LICENSE file.
+
+package discover
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"net"
+	"time"
+
+	"github.com/fcavani/e"
+	"github.com/fcavani/log"
+)
+
+// ErrCookie is returned when the server answers with a cookie challenge.
+const ErrCookie = "cookie challenge"
+
+// cookieLifetime is the period of the cookies. A cookie is accepted in the
+// period that it was made and in the next one.
+const cookieLifetime = 30 * time.Second
+
+const cookieMacSize = 16
+
+// cookies makes and checks the stateless cookies sent to the clients.
+// The cookie is the period followed by the hmac of the period and the
+// client address, so the server doesn't need to remember it.
+type cookies struct {
+	secret []byte
+}
+
+func newCookies() (*cookies, error) {
+	secret := make([]byte, sha256.Size)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return nil, e.Push(err, "can't create the cookie secret")
+	}
+	return &cookies{secret: secret}, nil
+}
+
+func (c *cookies) mac(period uint64, addr *net.UDPAddr) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, period)
+	m := hmac.New(sha256.New, c.secret)
+	m.Write(buf)
+	m.Write(addr.IP.To16())
+	binary.BigEndian.PutUint64(buf, uint64(addr.Port))
+	m.Write(buf)
+	return m.Sum(nil)[:cookieMacSize]
+}
+
+// Make returns a new cookie for the address.
+func (c *cookies) Make(addr *net.UDPAddr) []byte {
+	period := uint64(time.Now().UnixNano() / int64(cookieLifetime))
+	cookie := make([]byte, 8, 8+cookieMacSize)
+	binary.BigEndian.PutUint64(cookie, period)
+	return append(cookie, c.mac(period, addr)...)
+}
+
+// Valid returns true if the cookie was made for the address and isn't
+// expired.
+func (c *cookies) Valid(addr *net.UDPAddr, cookie []byte) bool {
+	if len(cookie) != 8+cookieMacSize {
+		return false
+	}
+	period := binary.BigEndian.Uint64(cookie)
+	now := uint64(time.Now().UnixNano() / int64(cookieLifetime))
+	if period != now && period+1 != now {
+		return false
+	}
+	return hmac.Equal(cookie[8:], c.mac(period, addr))
+}
+
+// sendCookie sends a cookie challenge to addr. The challenge is smaller than
+// any request, so it can't be used to amplify an attack.
+func (a *Server) sendCookie(ln *listener, addr *net.UDPAddr, to string) {
+	buf := bytes.NewBuffer([]byte{})
+	enc := gob.NewEncoder(buf)
+	msg := &Msg{
+		From:   a.Name,
+		To:     to,
+		Cookie: a.cookies.Make(addr),
+	}
+	err := enc.Encode(msg)
+	if err != nil {
+		log.Tag("discover", "server").Error("Error encoding cookie:", err)
+		return
+	}
+	_, _, err = ln.conn.WriteMsgUDP(buf.Bytes(), nil, addr)
+	if err != nil {
+		log.Tag("discover", "server").Errorf("Error sending cookie to %v: %v", addr, err)
+	}
+}
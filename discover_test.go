@@ -5,14 +5,21 @@
 package discover
 
 import (
+	"bytes"
 	"crypto/rand"
 	"crypto/rsa"
+	"encoding/gob"
 	"fmt"
+	"math"
 	"net"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/fcavani/e"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 )
 
 var MasterKey *rsa.PrivateKey
@@ -551,6 +558,2085 @@ func TestClientAgain(t *testing.T) {
 	}
 }
 
+func TestServerGroupKey(t *testing.T) {
+	in, err := Discover(net.FlagLoopback)
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+
+	server := &Server{}
+	server.Name = "master"
+	server.GroupKey = []byte("group secret")
+	server.Interface = in
+	server.AddrVer = Ipv4
+	server.Protocol = func(addr *net.UDPAddr, req *Request) (resp *Response, err error) {
+		if string(req.Data) != "request" {
+			return nil, e.New("protocol error")
+		}
+		t.Log(req)
+		return &Response{
+			Data: []byte("msg"),
+		}, nil
+	}
+	err = server.Do()
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer server.Close()
+
+	client := &Client{}
+	client.ServerName = "master"
+	client.Name = "slave"
+	client.GroupKey = []byte("group secret")
+	client.Interface = in
+	client.AddrVer = Ipv4
+	client.Port = server.Port
+	client.Request = func(dst *net.UDPAddr) (*Request, error) {
+		return &Request{
+			Data: []byte("request"),
+		}, nil
+	}
+	resp, err := client.Discover()
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	if string(resp.Data) != "msg" {
+		t.Fatal("received wrong message", string(resp.Data))
+	}
+	t.Log(resp)
+
+	client = &Client{}
+	client.ServerName = "master"
+	client.Name = "intruder"
+	client.GroupKey = []byte("wrong secret")
+	client.Interface = in
+	client.AddrVer = Ipv4
+	client.Port = server.Port
+	client.Timeout = 1 * time.Second
+	client.Deadline = 100 * time.Millisecond
+	client.Request = func(dst *net.UDPAddr) (*Request, error) {
+		return &Request{
+			Data: []byte("request"),
+		}, nil
+	}
+	_, err = client.Discover()
+	if !e.Equal(err, "can't find the server") {
+		t.Fatal("client with the wrong group key was accepted", err)
+	}
+}
+
+func TestServerOpen(t *testing.T) {
+	in, err := Discover(net.FlagLoopback)
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+
+	for _, mode := range []OpenMode{OpenSigned, OpenPlain} {
+		server := &Server{}
+		server.Name = "master"
+		server.PrivateKey = MasterKey
+		server.PubKeys = Keys
+		server.Open = mode
+		server.Interface = in
+		server.AddrVer = Ipv4
+		server.Protocol = func(addr *net.UDPAddr, req *Request) (resp *Response, err error) {
+			if string(req.Data) != "request" {
+				return nil, e.New("protocol error")
+			}
+			t.Log(req)
+			return &Response{
+				Data: []byte("msg"),
+			}, nil
+		}
+		err = server.Do()
+		if err != nil {
+			t.Fatal(e.Trace(e.Forward(err)))
+		}
+
+		client := &Client{}
+		client.ServerName = "master"
+		client.Name = "printer"
+		client.Open = true
+		if mode == OpenSigned {
+			client.ServerKey = &MasterKey.PublicKey
+		}
+		client.Interface = in
+		client.AddrVer = Ipv4
+		client.Port = server.Port
+		client.Request = func(dst *net.UDPAddr) (*Request, error) {
+			return &Request{
+				Data: []byte("request"),
+			}, nil
+		}
+		resp, err := client.Discover()
+		if err != nil {
+			t.Fatal(e.Trace(e.Forward(err)))
+		}
+		if string(resp.Data) != "msg" {
+			t.Fatal("received wrong message", string(resp.Data))
+		}
+		t.Log(resp)
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestServerEvents(t *testing.T) {
+	in, err := Discover(net.FlagLoopback)
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+
+	events := make(chan string, 100)
+	event := func(name string) func(s *Session) {
+		return func(s *Session) {
+			if s.Name != "slave" {
+				t.Error("wrong client name", s.Name)
+			}
+			events <- name
+		}
+	}
+
+	server := &Server{}
+	server.Name = "master"
+	server.PrivateKey = MasterKey
+	server.PubKeys = Keys
+	server.Interface = in
+	server.AddrVer = Ipv4
+	server.OnRequest = event("request")
+	server.OnConfirm = event("confirm")
+	server.OnKeepAlive = event("keepalive")
+	server.OnLeave = event("leave")
+	server.Keepalive = 100 * time.Millisecond
+	server.Protocol = func(addr *net.UDPAddr, req *Request) (resp *Response, err error) {
+		return &Response{}, nil
+	}
+	err = server.Do()
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+
+	client := &Client{}
+	client.ServerName = "master"
+	client.ServerKey = &MasterKey.PublicKey
+	client.Name = "slave"
+	client.PrivateKey = SlaveKey
+	client.Interface = in
+	client.AddrVer = Ipv4
+	client.Port = server.Port
+	client.Keepalive = 100 * time.Millisecond
+	client.Request = func(dst *net.UDPAddr) (*Request, error) {
+		return &Request{}, nil
+	}
+	_, err = client.Discover()
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+
+	for _, want := range []string{"request", "confirm", "keepalive"} {
+		select {
+		case got := <-events:
+			if got != want {
+				t.Fatalf("wrong event %v, want %v", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("event not received", want)
+		}
+	}
+	// The client leaves before the server is closed.
+	client.Close()
+	defer server.Close()
+
+	for {
+		select {
+		case got := <-events:
+			if got == "leave" {
+				if len(server.Sessions()) != 0 {
+					t.Fatal("session not removed")
+				}
+				return
+			} else if got != "keepalive" {
+				t.Fatal("wrong event", got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("leave event not received")
+		}
+	}
+}
+
+func TestServerSessions(t *testing.T) {
+	in, err := Discover(net.FlagLoopback)
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+
+	server := &Server{}
+	server.Name = "master"
+	server.PrivateKey = MasterKey
+	server.PubKeys = Keys
+	server.Interface = in
+	server.AddrVer = Ipv4
+	server.Protocol = func(addr *net.UDPAddr, req *Request) (resp *Response, err error) {
+		return &Response{}, nil
+	}
+	err = server.Do()
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer server.Close()
+
+	client := &Client{}
+	client.ServerName = "master"
+	client.ServerKey = &MasterKey.PublicKey
+	client.Name = "slave"
+	client.PrivateKey = SlaveKey
+	client.Interface = in
+	client.AddrVer = Ipv4
+	client.Port = server.Port
+	client.Request = func(dst *net.UDPAddr) (*Request, error) {
+		return &Request{}, nil
+	}
+	resp, err := client.Discover()
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer client.Close()
+
+	sessions := server.Sessions()
+	if len(sessions) != 1 {
+		t.Fatal("wrong number of sessions", len(sessions))
+	}
+	if sessions[0].Id != resp.Id || sessions[0].Name != "slave" {
+		t.Fatal("wrong session", sessions[0])
+	}
+	s, err := server.Session(resp.Id)
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	if s.Seq != resp.Seq || s.Addr.String() != resp.Ip {
+		t.Fatal("wrong session", s)
+	}
+
+	err = server.Kick(resp.Id)
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	if len(server.Sessions()) != 0 {
+		t.Fatal("session not removed")
+	}
+	_, err = server.Session(resp.Id)
+	if !e.Equal(err, ErrCtxNotFound) {
+		t.Fatal("session not removed", err)
+	}
+}
+
+func TestServerLeave(t *testing.T) {
+	in, err := Discover(net.FlagLoopback)
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+
+	left := make(chan string, 1)
+	server := &Server{}
+	server.Name = "master"
+	server.PrivateKey = MasterKey
+	server.PubKeys = Keys
+	server.Interface = in
+	server.AddrVer = Ipv4
+	server.OnLeave = func(s *Session) {
+		left <- s.Id
+	}
+	server.Protocol = func(addr *net.UDPAddr, req *Request) (resp *Response, err error) {
+		return &Response{}, nil
+	}
+	err = server.Do()
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer server.Close()
+
+	for _, stale := range []bool{true, false} {
+		client := &Client{}
+		client.ServerName = "master"
+		client.ServerKey = &MasterKey.PublicKey
+		client.Name = "slave"
+		client.PrivateKey = SlaveKey
+		client.Interface = in
+		client.AddrVer = Ipv4
+		client.Port = server.Port
+		client.Request = func(dst *net.UDPAddr) (*Request, error) {
+			return &Request{}, nil
+		}
+		resp, err := client.Discover()
+		if err != nil {
+			t.Fatal(e.Trace(e.Forward(err)))
+		}
+		if stale {
+			// The leave of other session is ignored.
+			client.seq++
+		}
+		start := time.Now()
+		err = client.Close()
+		if err != nil {
+			t.Fatal(e.Trace(e.Forward(err)))
+		}
+		if time.Since(start) > time.Second {
+			t.Fatal("close waited the server")
+		}
+		select {
+		case id := <-left:
+			if stale || id != resp.Id {
+				t.Fatal("wrong session left", id)
+			}
+		case <-time.After(500 * time.Millisecond):
+			if !stale {
+				t.Fatal("session didn't leave")
+			}
+			err = server.Kick(resp.Id)
+			if err != nil {
+				t.Fatal(e.Trace(e.Forward(err)))
+			}
+			<-left
+		}
+	}
+}
+
+func TestServerExpire(t *testing.T) {
+	in, err := Discover(net.FlagLoopback)
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+
+	expired := make(chan *Session, 1)
+
+	server := &Server{}
+	server.Name = "master"
+	server.PrivateKey = MasterKey
+	server.PubKeys = Keys
+	server.Interface = in
+	server.AddrVer = Ipv4
+	server.Keepalive = 100 * time.Millisecond
+	server.MissedKeepalives = 2
+	server.OnExpire = func(s *Session) {
+		expired <- s
+	}
+	server.Protocol = func(addr *net.UDPAddr, req *Request) (resp *Response, err error) {
+		return &Response{}, nil
+	}
+	err = server.Do()
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer server.Close()
+
+	client := &Client{}
+	client.ServerName = "master"
+	client.ServerKey = &MasterKey.PublicKey
+	client.Name = "slave"
+	client.PrivateKey = SlaveKey
+	client.Interface = in
+	client.AddrVer = Ipv4
+	client.Port = server.Port
+	client.Keepalive = 200 * time.Millisecond
+	client.Request = func(dst *net.UDPAddr) (*Request, error) {
+		return &Request{}, nil
+	}
+	resp, err := client.Discover()
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	if resp.Keepalive != 200*time.Millisecond || resp.Timeout != 400*time.Millisecond {
+		t.Fatal("wrong keepalive negotiation", resp.Keepalive, resp.Timeout)
+	}
+
+	// The session stays alive while the client sends keepalives.
+	time.Sleep(time.Second)
+	select {
+	case s := <-expired:
+		t.Fatal("session expired", s)
+	default:
+	}
+
+	// Stop the keepalives without leave, like a crashed client.
+	ch := make(chan struct{})
+	client.stopKa <- ch
+	<-ch
+	defer client.conn.Close()
+	select {
+	case s := <-expired:
+		if s.Id != resp.Id {
+			t.Fatal("wrong session expired", s)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("session didn't expire")
+	}
+}
+
+func TestServerMaxKeepalive(t *testing.T) {
+	in, err := Discover(net.FlagLoopback)
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+
+	for _, tc := range []struct {
+		max       time.Duration
+		keepalive time.Duration
+		timeout   time.Duration
+	}{
+		{150 * time.Millisecond, 150 * time.Millisecond, 450 * time.Millisecond},
+		{math.MaxInt64, math.MaxInt64 / 2, math.MaxInt64},
+	} {
+		server := &Server{}
+		server.Name = "master"
+		server.PrivateKey = MasterKey
+		server.PubKeys = Keys
+		server.Interface = in
+		server.AddrVer = Ipv4
+		server.Keepalive = 100 * time.Millisecond
+		server.MaxKeepalive = tc.max
+		server.MissedKeepalives = 3
+		server.Protocol = func(addr *net.UDPAddr, req *Request) (resp *Response, err error) {
+			return &Response{}, nil
+		}
+		err = server.Do()
+		if err != nil {
+			t.Fatal(e.Trace(e.Forward(err)))
+		}
+
+		client := &Client{}
+		client.ServerName = "master"
+		client.ServerKey = &MasterKey.PublicKey
+		client.Name = "slave"
+		client.PrivateKey = SlaveKey
+		client.Interface = in
+		client.AddrVer = Ipv4
+		client.Port = server.Port
+		client.Keepalive = math.MaxInt64 / 2
+		client.Request = func(dst *net.UDPAddr) (*Request, error) {
+			return &Request{}, nil
+		}
+		resp, err := client.Discover()
+		if err != nil {
+			t.Fatal(e.Trace(e.Forward(err)))
+		}
+		if resp.Keepalive != tc.keepalive || resp.Timeout != tc.timeout {
+			t.Fatal("wrong keepalive", resp.Keepalive, resp.Timeout)
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestPhi(t *testing.T) {
+	now := time.Now()
+	p := newPhi(time.Second, 0)
+	p.last = now
+	for i := 1; i <= 10; i++ {
+		p.Heartbeat(now.Add(time.Duration(i) * time.Second))
+	}
+	now = now.Add(10 * time.Second)
+	if phi := p.Phi(now.Add(500 * time.Millisecond)); phi > 1 {
+		t.Fatal("suspicion too high", phi)
+	}
+	if phi := p.Phi(now.Add(3 * time.Second)); phi < 8 {
+		t.Fatal("suspicion too low", phi)
+	}
+	prev := 0.0
+	for d := time.Duration(0); d < 5*time.Second; d += 100 * time.Millisecond {
+		phi := p.Phi(now.Add(d))
+		if phi < prev {
+			t.Fatal("suspicion must not decrease over time", d, phi, prev)
+		}
+		prev = phi
+	}
+
+	p = newPhi(time.Second, 2*time.Second)
+	p.last = now
+	if phi := p.Phi(now.Add(2 * time.Second)); phi > 1 {
+		t.Fatal("pause not accepted", phi)
+	}
+}
+
+func TestContextsHistory(t *testing.T) {
+	ctxs := newContexts(time.Hour, 8, nil)
+	defer ctxs.Close()
+	err := ctxs.Register(&context{Id: "id", Keepalive: time.Second, Timeout: 3 * time.Second})
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	for i := 0; i < 3; i++ {
+		_, err = ctxs.KeepAlive("id")
+		if err != nil {
+			t.Fatal(e.Trace(e.Forward(err)))
+		}
+	}
+	ctx, err := ctxs.Get("id")
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	detector := ctx.detector
+	ctx, err = ctxs.Move("id", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, "lo")
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	if ctx.detector != detector || len(detector.intervals) != 5 {
+		t.Fatal("arrival history lost")
+	}
+}
+
+func TestServerShutdownTwice(t *testing.T) {
+	in, err := Discover(net.FlagLoopback)
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+
+	server := &Server{}
+	server.Name = "master"
+	server.PrivateKey = MasterKey
+	server.PubKeys = Keys
+	server.Interface = in
+	server.AddrVer = Ipv4
+	server.Protocol = func(addr *net.UDPAddr, req *Request) (resp *Response, err error) {
+		return &Response{}, nil
+	}
+	err = server.Do()
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	err = server.Close()
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Close()
+	}()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal(e.Trace(e.Forward(err)))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("second close blocked")
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	in, err := Discover(net.FlagLoopback)
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+
+	server := &Server{}
+	server.Name = "master"
+	server.PrivateKey = MasterKey
+	server.PubKeys = Keys
+	server.Interface = in
+	server.AddrVer = Ipv4
+	server.Successor = "127.0.0.1:4444"
+	server.Protocol = func(addr *net.UDPAddr, req *Request) (resp *Response, err error) {
+		return &Response{}, nil
+	}
+	err = server.Do()
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+
+	successor := make(chan string, 1)
+
+	client := &Client{}
+	client.ServerName = "master"
+	client.ServerKey = &MasterKey.PublicKey
+	client.Name = "slave"
+	client.PrivateKey = SlaveKey
+	client.Interface = in
+	client.AddrVer = Ipv4
+	client.Port = server.Port
+	client.OnShutdown = func(s string) {
+		successor <- s
+	}
+	client.Request = func(dst *net.UDPAddr) (*Request, error) {
+		return &Request{}, nil
+	}
+	_, err = client.Discover()
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer client.Close()
+
+	err = server.Close()
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	select {
+	case s := <-successor:
+		if s != "127.0.0.1:4444" {
+			t.Fatal("wrong successor", s)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("shutdown notice not received")
+	}
+}
+
+func TestClientCurrent(t *testing.T) {
+	client := &Client{Id: "id", seq: 2}
+	if !client.current(&Response{Id: "id", Seq: 2, Closing: true}) {
+		t.Fatal("notice of the session ignored")
+	}
+	if client.current(&Response{Id: "other", Seq: 2, Closing: true}) {
+		t.Fatal("notice of other client accepted")
+	}
+	if client.current(&Response{Id: "id", Seq: 1, Closing: true}) {
+		t.Fatal("notice of an old session accepted")
+	}
+}
+
+func TestClientSupervise(t *testing.T) {
+	in, err := Discover(net.FlagLoopback)
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+
+	protocol := func(addr *net.UDPAddr, req *Request) (resp *Response, err error) {
+		return &Response{}, nil
+	}
+
+	successor := &Server{}
+	successor.Name = "backup"
+	successor.PrivateKey = MasterKey
+	successor.PubKeys = Keys
+	successor.Interface = in
+	successor.AddrVer = Ipv4
+	successor.Protocol = protocol
+	err = successor.Do()
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer successor.Close()
+
+	server := &Server{}
+	server.Name = "master"
+	server.PrivateKey = MasterKey
+	server.PubKeys = Keys
+	server.Interface = in
+	server.AddrVer = Ipv4
+	server.Successor = "127.0.0.1:" + successor.Port
+	server.Protocol = protocol
+	err = server.Do()
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+
+	states := make(chan State, 10)
+
+	client := &Client{}
+	client.ServerName = "master"
+	client.ServerKey = &MasterKey.PublicKey
+	client.Name = "slave"
+	client.PrivateKey = SlaveKey
+	client.Interface = in
+	client.AddrVer = Ipv4
+	client.Port = server.Port
+	client.Supervise = true
+	client.Servers = []ServerInfo{{Name: "backup", Key: &MasterKey.PublicKey}}
+	client.Timeout = 5 * time.Second
+	client.Deadline = 200 * time.Millisecond
+	client.OnState = func(s State) {
+		states <- s
+	}
+	client.Request = func(dst *net.UDPAddr) (*Request, error) {
+		return &Request{}, nil
+	}
+	resp, err := client.Discover()
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer client.Close()
+
+	err = server.Close()
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+
+	for _, want := range []State{Discovering, Connected, Lost, Discovering, Connected} {
+		select {
+		case got := <-states:
+			if got != want {
+				t.Fatalf("wrong state %v, want %v", got, want)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("state not reached", want)
+		}
+	}
+
+	s, err := successor.Session(resp.Id)
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	if s.Name != "slave" {
+		t.Fatal("wrong session", s)
+	}
+}
+
+func TestClientKeepAliveStatus(t *testing.T) {
+	in, err := Discover(net.FlagLoopback)
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+
+	server := &Server{}
+	server.Name = "master"
+	server.PrivateKey = MasterKey
+	server.PubKeys = Keys
+	server.Interface = in
+	server.AddrVer = Ipv4
+	server.Keepalive = 100 * time.Millisecond
+	server.Protocol = func(addr *net.UDPAddr, req *Request) (resp *Response, err error) {
+		return &Response{}, nil
+	}
+	err = server.Do()
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer server.Close()
+
+	states := make(chan State, 10)
+	rtts := make(chan error, 100)
+
+	client := &Client{}
+	client.ServerName = "master"
+	client.ServerKey = &MasterKey.PublicKey
+	client.Name = "slave"
+	client.PrivateKey = SlaveKey
+	client.Interface = in
+	client.AddrVer = Ipv4
+	client.Port = server.Port
+	client.Keepalive = 100 * time.Millisecond
+	client.Deadline = 100 * time.Millisecond
+	client.OnState = func(s State) {
+		states <- s
+	}
+	client.OnKeepAlive = func(rtt time.Duration, err error) {
+		select {
+		case rtts <- err:
+		default:
+		}
+	}
+	client.Request = func(dst *net.UDPAddr) (*Request, error) {
+		return &Request{}, nil
+	}
+	_, err = client.Discover()
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer client.Close()
+
+	select {
+	case err := <-rtts:
+		if err != nil {
+			t.Fatal(e.Trace(e.Forward(err)))
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("keepalive status not received")
+	}
+	if client.State() != Connected {
+		t.Fatal("wrong state", client.State())
+	}
+
+	// The server vanishes without notice.
+	server.closeListeners()
+
+	for _, want := range []State{Discovering, Connected, Degraded, Lost} {
+		select {
+		case got := <-states:
+			if got != want {
+				t.Fatalf("wrong state %v, want %v", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("state not reached", want)
+		}
+	}
+	if client.State() != Lost {
+		t.Fatal("wrong state", client.State())
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	exp := &ExponentialBackoff{Base: time.Second, Max: 10 * time.Second}
+	for i, want := range []time.Duration{1, 2, 4, 8, 10, 10} {
+		if got := exp.Next(i+1, 0); got != want*time.Second {
+			t.Fatalf("attempt %v: wrong wait %v, want %v", i+1, got, want*time.Second)
+		}
+	}
+	if got := exp.Next(1000, 0); got != 10*time.Second {
+		t.Fatal("wait not capped", got)
+	}
+
+	exp.Jitter = true
+	for i := 1; i < 100; i++ {
+		if got := exp.Next(i, 0); got < 0 || got > 10*time.Second {
+			t.Fatal("jitter out of range", got)
+		}
+	}
+
+	dj := &DecorrelatedJitter{Base: time.Second, Max: 10 * time.Second}
+	var wait time.Duration
+	for i := 1; i < 100; i++ {
+		prev := wait
+		wait = dj.Next(i, wait)
+		if wait < time.Second || wait > 10*time.Second {
+			t.Fatal("decorrelated jitter out of range", wait)
+		}
+		if prev >= time.Second && wait > 3*prev {
+			t.Fatal("decorrelated jitter too big", wait, prev)
+		}
+	}
+}
+
+func TestClientMaxAttempts(t *testing.T) {
+	in, err := Discover(net.FlagLoopback)
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+
+	attempts := 0
+	client := &Client{}
+	client.ServerName = "master"
+	client.ServerKey = &MasterKey.PublicKey
+	client.Name = "slave"
+	client.PrivateKey = SlaveKey
+	client.Interface = in
+	client.AddrVer = Ipv4
+	client.Port = "6466"
+	client.Deadline = 10 * time.Millisecond
+	client.Backoff = &ExponentialBackoff{Base: 10 * time.Millisecond, Max: 40 * time.Millisecond}
+	client.MaxAttempts = 4
+	client.Request = func(dst *net.UDPAddr) (*Request, error) {
+		attempts++
+		return &Request{}, nil
+	}
+	_, err = client.Discover()
+	if !e.Equal(err, "can't find the server") {
+		t.Fatal("wrong error", err)
+	}
+	if attempts != 4 {
+		t.Fatal("wrong number of attempts", attempts)
+	}
+}
+
+func TestServerAggregation(t *testing.T) {
+	in, err := Discover(net.FlagLoopback)
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+
+	var lck sync.Mutex
+	calls := 0
+
+	server := &Server{}
+	server.Name = "master"
+	server.PrivateKey = MasterKey
+	server.PubKeys = Keys
+	server.Interface = in
+	server.AddrVer = Ipv4
+	server.ResponseDelay = 500 * time.Millisecond
+	server.Protocol = func(addr *net.UDPAddr, req *Request) (resp *Response, err error) {
+		lck.Lock()
+		calls++
+		lck.Unlock()
+		return &Response{}, nil
+	}
+	err = server.Do()
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer server.Close()
+
+	// Two clients with the same id, like one client in two interfaces.
+	resps := make(chan *Response, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			client := &Client{}
+			client.ServerName = "master"
+			client.ServerKey = &MasterKey.PublicKey
+			client.Name = "slave"
+			client.PrivateKey = SlaveKey
+			client.Interface = in
+			client.AddrVer = Ipv4
+			client.Port = server.Port
+			client.Id = "f47ac10b-58cc-4372-a567-0e02b2c3d479"
+			client.Request = func(dst *net.UDPAddr) (*Request, error) {
+				return &Request{}, nil
+			}
+			resp, err := client.Discover()
+			if err != nil {
+				t.Error(e.Trace(e.Forward(err)))
+			}
+			resps <- resp
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case resp := <-resps:
+			if resp == nil {
+				t.Fatal("discover failed")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("response not received")
+		}
+	}
+	lck.Lock()
+	defer lck.Unlock()
+	if calls != 1 {
+		t.Fatal("requests not aggregated", calls)
+	}
+}
+
+func TestAggregationSame(t *testing.T) {
+	first := &peer{Name: "slave", Mode: RsaMode}
+	pend := &pending{
+		req:   &Request{Id: "id", Data: []byte("data")},
+		peers: []*peer{first},
+	}
+	if !pend.same(&peer{Name: "slave", Mode: RsaMode}, &Request{Id: "id", Data: []byte("data")}) {
+		t.Fatal("same request not aggregated")
+	}
+	for _, tc := range []struct {
+		p   *peer
+		req *Request
+	}{
+		{&peer{Name: "other", Mode: RsaMode}, &Request{Id: "id", Data: []byte("data")}},
+		{&peer{Name: "slave", Mode: PlainMode}, &Request{Id: "id", Data: []byte("data")}},
+		{&peer{Name: "slave", Mode: RsaMode}, &Request{Id: "id", Data: []byte("other")}},
+		{&peer{Name: "slave", Mode: RsaMode}, &Request{Id: "id", Data: []byte("data"), Keepalive: time.Second}},
+	} {
+		if pend.same(tc.p, tc.req) {
+			t.Fatal("different request aggregated", tc.p.Name, tc.p.Mode, string(tc.req.Data))
+		}
+	}
+}
+
+func TestServerNegativeDelay(t *testing.T) {
+	in, err := Discover(net.FlagLoopback)
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+
+	server := &Server{}
+	server.Name = "master"
+	server.PrivateKey = MasterKey
+	server.PubKeys = Keys
+	server.Interface = in
+	server.AddrVer = Ipv4
+	server.ResponseDelay = -time.Second
+	server.Protocol = func(addr *net.UDPAddr, req *Request) (resp *Response, err error) {
+		return &Response{}, nil
+	}
+	err = server.Do()
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer server.Close()
+
+	client := &Client{}
+	client.ServerName = "master"
+	client.ServerKey = &MasterKey.PublicKey
+	client.Name = "slave"
+	client.PrivateKey = SlaveKey
+	client.Interface = in
+	client.AddrVer = Ipv4
+	client.Port = server.Port
+	client.Request = func(dst *net.UDPAddr) (*Request, error) {
+		return &Request{}, nil
+	}
+	_, err = client.Discover()
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer client.Close()
+}
+
+func TestPool(t *testing.T) {
+	// Jobs with the same key run in order.
+	p := newPool(4, 8, Block)
+	var lck sync.Mutex
+	order := make([]int, 0)
+	for i := 0; i < 100; i++ {
+		i := i
+		p.Submit("client", func() {
+			lck.Lock()
+			order = append(order, i)
+			lck.Unlock()
+		}, nil)
+	}
+	p.Close()
+	for i, v := range order {
+		if i != v {
+			t.Fatal("jobs out of order", order)
+		}
+	}
+	if len(order) != 100 {
+		t.Fatal("jobs lost", len(order))
+	}
+
+	for _, policy := range []Overflow{DropNewest, DropOldest} {
+		p := newPool(1, 1, policy)
+		hold := make(chan struct{})
+		running := make(chan struct{})
+		p.Submit("a", func() {
+			close(running)
+			<-hold
+		}, nil)
+		<-running
+		dropped := make(chan string, 2)
+		drop := func(name string) func() {
+			return func() {
+				dropped <- name
+			}
+		}
+		if !p.Submit("a", func() {}, drop("old")) {
+			t.Fatal("job dropped with space in the queue")
+		}
+		if p.Submit("a", func() {}, drop("new")) {
+			t.Fatal("job not dropped with the queue full")
+		}
+		want := "new"
+		if policy == DropOldest {
+			want = "old"
+		}
+		if got := <-dropped; got != want {
+			t.Fatalf("%v: wrong job dropped %v, want %v", policy, got, want)
+		}
+		close(hold)
+		p.Close()
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	l := newLimiter(10, 2)
+	if !l.Allow("a") || !l.Allow("a") {
+		t.Fatal("burst not allowed")
+	}
+	if l.Allow("a") {
+		t.Fatal("rate limit not enforced")
+	}
+	if !l.Allow("b") {
+		t.Fatal("other key limited")
+	}
+	time.Sleep(150 * time.Millisecond)
+	if !l.Allow("a") {
+		t.Fatal("bucket not refilled")
+	}
+
+	b := newBanList(2, 100*time.Millisecond)
+	if b.Fail("a") {
+		t.Fatal("banned too early")
+	}
+	if !b.Fail("a") {
+		t.Fatal("not banned")
+	}
+	if !b.Banned("a") || b.Banned("b") {
+		t.Fatal("wrong ban list")
+	}
+	time.Sleep(150 * time.Millisecond)
+	if b.Banned("a") {
+		t.Fatal("ban not expired")
+	}
+}
+
+func TestServerBan(t *testing.T) {
+	in, err := Discover(net.FlagLoopback)
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+
+	server := &Server{}
+	server.Name = "master"
+	server.GroupKey = []byte("group secret")
+	server.Interface = in
+	server.AddrVer = Ipv4
+	server.BanAfter = 2
+	server.BanTime = time.Minute
+	server.Protocol = func(addr *net.UDPAddr, req *Request) (resp *Response, err error) {
+		return &Response{
+			Data: []byte("msg"),
+		}, nil
+	}
+	err = server.Do()
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer server.Close()
+
+	client := &Client{}
+	client.ServerName = "master"
+	client.Name = "intruder"
+	client.GroupKey = []byte("wrong secret")
+	client.Interface = in
+	client.AddrVer = Ipv4
+	client.Port = server.Port
+	client.Timeout = 1 * time.Second
+	client.Deadline = 100 * time.Millisecond
+	client.Request = func(dst *net.UDPAddr) (*Request, error) {
+		return &Request{
+			Data: []byte("request"),
+		}, nil
+	}
+	_, err = client.Discover()
+	if err == nil {
+		t.Fatal("intruder discovered the server")
+	}
+	if !server.bans.Banned("127.0.0.1") {
+		t.Fatal("intruder not banned")
+	}
+	if !server.Cookies {
+		t.Fatal("ban without cookies")
+	}
+}
+
+func TestCookies(t *testing.T) {
+	c, err := newCookies()
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+	cookie := c.Make(addr)
+	if !c.Valid(addr, cookie) {
+		t.Fatal("valid cookie refused")
+	}
+	if c.Valid(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1235}, cookie) {
+		t.Fatal("cookie accepted from other address")
+	}
+	if c.Valid(addr, nil) {
+		t.Fatal("empty cookie accepted")
+	}
+	cookie[len(cookie)-1] ^= 1
+	if c.Valid(addr, cookie) {
+		t.Fatal("forged cookie accepted")
+	}
+}
+
+func TestServerCookies(t *testing.T) {
+	in, err := Discover(net.FlagLoopback)
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+
+	server := &Server{}
+	server.Name = "master"
+	server.PrivateKey = MasterKey
+	server.PubKeys = Keys
+	server.Interface = in
+	server.AddrVer = Ipv4
+	server.Cookies = true
+	server.Keepalive = 100 * time.Millisecond
+	server.Protocol = func(addr *net.UDPAddr, req *Request) (resp *Response, err error) {
+		return &Response{
+			Data: []byte("msg"),
+		}, nil
+	}
+	err = server.Do()
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer server.Close()
+
+	kas := make(chan error, 10)
+	client := &Client{}
+	client.ServerName = "master"
+	client.ServerKey = &MasterKey.PublicKey
+	client.Name = "slave"
+	client.PrivateKey = SlaveKey
+	client.Interface = in
+	client.AddrVer = Ipv4
+	client.Port = server.Port
+	client.Keepalive = 100 * time.Millisecond
+	client.OnKeepAlive = func(rtt time.Duration, err error) {
+		select {
+		case kas <- err:
+		default:
+		}
+	}
+	client.Request = func(dst *net.UDPAddr) (*Request, error) {
+		return &Request{}, nil
+	}
+	resp, err := client.Discover()
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer client.Close()
+	if string(resp.Data) != "msg" {
+		t.Fatal("received wrong message", string(resp.Data))
+	}
+	if len(client.cookie(client.conn)) == 0 {
+		t.Fatal("client didn't receive the cookie")
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-kas:
+			if err != nil {
+				t.Fatal(e.Trace(e.Forward(err)))
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("keepalive timeout")
+		}
+	}
+}
+
+func TestServerInterfaces(t *testing.T) {
+	in, err := Discover(net.FlagLoopback)
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+
+	server := &Server{}
+	server.Name = "master"
+	server.PrivateKey = MasterKey
+	server.PubKeys = Keys
+	server.AllInterfaces = true
+	server.AddrVer = Ipv4
+	server.Protocol = func(addr *net.UDPAddr, req *Request) (resp *Response, err error) {
+		return &Response{}, nil
+	}
+	err = server.Do()
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer server.Close()
+
+	found := false
+	for _, ln := range server.listeners {
+		t.Log(ln.Name(), ln.conn.LocalAddr())
+		if ln.Name() == in {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("server isn't listening in", in)
+	}
+
+	client := &Client{}
+	client.ServerName = "master"
+	client.ServerKey = &MasterKey.PublicKey
+	client.Name = "slave"
+	client.PrivateKey = SlaveKey
+	client.Interface = in
+	client.AddrVer = Ipv4
+	client.Port = server.Port
+	client.Request = func(dst *net.UDPAddr) (*Request, error) {
+		return &Request{}, nil
+	}
+	resp, err := client.Discover()
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer client.Close()
+
+	s, err := server.Session(resp.Id)
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	if s.Interface != in {
+		t.Fatal("wrong interface", s.Interface)
+	}
+}
+
+func TestClientProbes(t *testing.T) {
+	in, err := Discover(net.FlagLoopback)
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+
+	server := &Server{}
+	server.Name = "master"
+	server.PrivateKey = MasterKey
+	server.PubKeys = Keys
+	server.Interface = in
+	server.AddrVer = Ipv4
+	server.Protocol = func(addr *net.UDPAddr, req *Request) (resp *Response, err error) {
+		return &Response{
+			Data: []byte("msg"),
+		}, nil
+	}
+	err = server.Do()
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer server.Close()
+
+	client := &Client{}
+	client.ServerName = "master"
+	client.ServerKey = &MasterKey.PublicKey
+	client.Name = "slave"
+	client.PrivateKey = SlaveKey
+	client.AllInterfaces = true
+	client.ProbeDelay = 10 * time.Millisecond
+	client.Port = server.Port
+	client.Timeout = 2 * time.Second
+	client.Deadline = 100 * time.Millisecond
+	client.Request = func(dst *net.UDPAddr) (*Request, error) {
+		return &Request{}, nil
+	}
+	resp, err := client.Discover()
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer client.Close()
+	if string(resp.Data) != "msg" {
+		t.Fatal("received wrong message", string(resp.Data))
+	}
+
+	probes, err := client.probes()
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	t.Log(len(probes), "probes")
+
+	s, err := server.Session(resp.Id)
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	if s.Addr.String() != client.conn.LocalAddr().String() {
+		t.Fatal("session isn't of the winner probe", s.Addr, client.conn.LocalAddr())
+	}
+}
+
+func TestServerDualStack(t *testing.T) {
+	in, err := Discover(net.FlagLoopback)
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+
+	server := &Server{}
+	server.Name = "master"
+	server.PrivateKey = MasterKey
+	server.PubKeys = Keys
+	server.AllInterfaces = true
+	server.DualStack = true
+	server.Protocol = func(addr *net.UDPAddr, req *Request) (resp *Response, err error) {
+		return &Response{}, nil
+	}
+	err = server.Do()
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer server.Close()
+
+	for _, ln := range server.listeners {
+		t.Log(ln.Name(), ln.ver, ln.conn.LocalAddr())
+	}
+
+	var id string
+	for _, ver := range []AddrVer{Ipv4, Ipv6} {
+		client := &Client{}
+		client.ServerName = "master"
+		client.ServerKey = &MasterKey.PublicKey
+		client.Name = "slave"
+		client.PrivateKey = SlaveKey
+		client.Interface = in
+		client.AddrVer = ver
+		client.Port = server.Port
+		client.Id = id
+		client.Request = func(dst *net.UDPAddr) (*Request, error) {
+			return &Request{}, nil
+		}
+		resp, err := client.Discover()
+		if err != nil {
+			t.Fatal(e.Trace(e.Forward(err)))
+		}
+		// The leave would end the session, so the clients are closed at
+		// the end.
+		defer client.Close()
+		id = resp.Id
+		sessions := server.Sessions()
+		if len(sessions) != 1 {
+			t.Fatal("wrong number of sessions", len(sessions))
+		}
+		if !ver.AddrAllowed(sessions[0].Addr.IP.String()) {
+			t.Fatal("session not moved to the new address", sessions[0].Addr)
+		}
+	}
+}
+
+func TestIntfacePolicy(t *testing.T) {
+	lo, err := Discover(net.FlagLoopback)
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	names := func(i *Intface) []string {
+		ints, err := i.candidates()
+		if err != nil {
+			t.Fatal(e.Trace(e.Forward(err)))
+		}
+		names := make([]string, 0, len(ints))
+		for _, in := range ints {
+			names = append(names, in.Name)
+		}
+		return names
+	}
+
+	got := names(&Intface{Include: []string{lo + "*"}})
+	if len(got) != 1 || got[0] != lo {
+		t.Fatal("include failed", got)
+	}
+	for _, name := range names(&Intface{Exclude: []string{lo}}) {
+		if name == lo {
+			t.Fatal("exclude failed")
+		}
+	}
+	for _, name := range names(&Intface{NotVirtual: true}) {
+		if name == lo {
+			t.Fatal("loopback isn't virtual")
+		}
+	}
+	got = names(&Intface{Prefer: []string{"nothing", lo}})
+	if len(got) == 0 || got[0] != lo {
+		t.Fatal("prefer failed", got)
+	}
+	got = names(&Intface{Networks: []string{"127.0.0.0/8"}})
+	if len(got) != 1 || got[0] != lo {
+		t.Fatal("networks failed", got)
+	}
+	_, err = (&Intface{Networks: []string{"invalid"}}).candidates()
+	if err == nil {
+		t.Fatal("invalid network accepted")
+	}
+}
+
+func TestIntfaceReset(t *testing.T) {
+	auto := &Intface{}
+	err := auto.getInt()
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	if auto.Interface == "" {
+		t.Skip("no interface")
+	}
+	auto.reset()
+	if auto.Interface != "" || auto.iface != nil {
+		t.Fatal("automatic selection kept", auto.Interface)
+	}
+
+	lo, err := Discover(net.FlagLoopback)
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	fixed := &Intface{Interface: lo}
+	err = fixed.getInt()
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	fixed.reset()
+	if fixed.Interface != lo || fixed.iface != nil {
+		t.Fatal("wrong interface after reset", fixed.Interface)
+	}
+}
+
+func TestNetChanges(t *testing.T) {
+	old := map[string]*netState{
+		"eth0": {up: true, addrs: map[string]bool{"10.0.0.1/24": true}},
+		"eth1": {up: true, addrs: map[string]bool{}},
+	}
+	cur := map[string]*netState{
+		"eth0": {up: true, addrs: map[string]bool{"10.0.0.2/24": true}},
+		"eth2": {up: true, addrs: map[string]bool{}},
+	}
+	want := []NetEvent{
+		{Type: AddrAdded, Interface: "eth0", Addr: "10.0.0.2/24"},
+		{Type: AddrRemoved, Interface: "eth0", Addr: "10.0.0.1/24"},
+		{Type: IntDown, Interface: "eth1"},
+		{Type: IntUp, Interface: "eth2"},
+	}
+	got := changes(old, cur)
+	if len(got) != len(want) {
+		t.Fatal("wrong events", got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatal("wrong event", got[i], want[i])
+		}
+	}
+	if len(changes(cur, cur)) != 0 {
+		t.Fatal("events without changes")
+	}
+}
+
+func TestServerMonitor(t *testing.T) {
+	in, err := Discover(net.FlagLoopback)
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+
+	events := make(chan NetEvent, 10)
+	server := &Server{}
+	server.Name = "master"
+	server.PrivateKey = MasterKey
+	server.PubKeys = Keys
+	server.Interface = in
+	server.AddrVer = Ipv4
+	server.OnNetEvent = func(ev NetEvent) {
+		events <- ev
+	}
+	server.Protocol = func(addr *net.UDPAddr, req *Request) (resp *Response, err error) {
+		return &Response{}, nil
+	}
+	err = server.Do()
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer server.Close()
+
+	// Pretend that the loopback had no addresses.
+	states, err := snapshot()
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	states[in] = &netState{up: true, addrs: map[string]bool{}}
+	old := server.listeners[0].conn
+	server.watcher = newWatcher(time.Hour)
+	go server.monitor(server.watcher, states)
+	server.watcher.signal()
+
+	rebound := false
+	for !rebound {
+		select {
+		case ev := <-events:
+			t.Log(ev.Type, ev.Interface, ev.Addr)
+			if ev.Type == RebindFailed {
+				t.Fatal(e.Trace(e.Forward(ev.Err)))
+			}
+			rebound = ev.Type == Rebound
+		case <-time.After(5 * time.Second):
+			t.Fatal("server not rebound")
+		}
+	}
+	server.lckListeners.RLock()
+	if server.listeners[0].conn == old {
+		t.Fatal("socket not replaced")
+	}
+	server.lckListeners.RUnlock()
+
+	client := &Client{}
+	client.ServerName = "master"
+	client.ServerKey = &MasterKey.PublicKey
+	client.Name = "slave"
+	client.PrivateKey = SlaveKey
+	client.Interface = in
+	client.AddrVer = Ipv4
+	client.Port = server.Port
+	client.Request = func(dst *net.UDPAddr) (*Request, error) {
+		return &Request{}, nil
+	}
+	_, err = client.Discover()
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer client.Close()
+}
+
+func TestMulticastTune(t *testing.T) {
+	in, err := Discover(net.FlagLoopback)
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	iface, err := net.InterfaceByName(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &MulticastAddr{McTTL: 5, McNoLoop: true}
+	m.InitMCast()
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	err = m.tune(conn, iface, net.IPv4(224, 0, 0, 1))
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	p4 := ipv4.NewPacketConn(conn)
+	ttl, err := p4.MulticastTTL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl != 5 {
+		t.Fatal("wrong ttl", ttl)
+	}
+	loop, err := p4.MulticastLoopback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loop {
+		t.Fatal("loopback not disabled")
+	}
+
+	conn6, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Skip("no ipv6:", err)
+	}
+	defer conn6.Close()
+	err = m.tune(conn6, iface, net.ParseIP("ff02::1"))
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	p6 := ipv6.NewPacketConn(conn6)
+	hops, err := p6.MulticastHopLimit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hops != 5 {
+		t.Fatal("wrong hop limit", hops)
+	}
+
+	m.McInterface = "nonexistent0"
+	err = m.tune(conn, iface, net.IPv4(224, 0, 0, 1))
+	if err == nil {
+		t.Fatal("tune with an invalid interface")
+	}
+}
+
+func TestMulticastSources(t *testing.T) {
+	m := &MulticastAddr{McSources: []string{"192.0.2.9", "2001:db8::9"}}
+	if !m.isSource("192.0.2.9") || m.isSource("192.0.2.10") {
+		t.Fatal("isSource failed")
+	}
+	srcs, err := m.sources(net.ParseIP("232.0.0.1"))
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	if len(srcs) != 1 || !srcs[0].Equal(net.ParseIP("192.0.2.9")) {
+		t.Fatal("wrong sources", srcs)
+	}
+
+	in, err := Discover(net.FlagMulticast)
+	if err != nil {
+		t.Skip("no multicast interface")
+	}
+	iface, err := net.InterfaceByName(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gaddr := &net.UDPAddr{IP: net.ParseIP("232.0.0.1")}
+	conn, err := m.listenSources("udp4", iface, gaddr)
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	conn.Close()
+
+	m.McSources = []string{"2001:db8::9"}
+	_, err = m.listenSources("udp4", iface, gaddr)
+	if !e.Equal(err, ErrNoSources) {
+		t.Fatal("joined without sources", err)
+	}
+	m.McSources = []string{"invalid"}
+	_, err = m.listenSources("udp4", iface, gaddr)
+	if err == nil {
+		t.Fatal("joined an invalid source")
+	}
+}
+
+func TestDirectedBroadcast(t *testing.T) {
+	tests := []struct {
+		cidr  string
+		bcast net.IP
+	}{
+		{"192.168.1.10/24", net.IPv4(192, 168, 1, 255)},
+		{"10.1.2.3/8", net.IPv4(10, 255, 255, 255)},
+		{"172.16.5.1/20", net.IPv4(172, 16, 15, 255)},
+		{"192.168.1.10/31", nil},
+		{"192.168.1.10/32", nil},
+		{"fd00::1/64", nil},
+	}
+	for _, test := range tests {
+		ip, ipnet, err := net.ParseCIDR(test.cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ipnet.IP = ip
+		bcast := directed(ipnet)
+		if test.bcast == nil && bcast != nil || test.bcast != nil && !test.bcast.Equal(bcast) {
+			t.Fatal("wrong broadcast", test.cidr, bcast)
+		}
+	}
+
+	in, err := Discover(net.FlagBroadcast)
+	if err != nil {
+		t.Skip("no broadcast interface")
+	}
+	iface, err := net.InterfaceByName(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bcasts, err := subnets(iface)
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.To4() == nil {
+			continue
+		}
+		dst, err := broadcast(iface, &net.UDPAddr{IP: ipnet.IP}, "3456")
+		if err != nil {
+			t.Fatal(e.Trace(e.Forward(err)))
+		}
+		want := directed(ipnet)
+		if want == nil {
+			want = net.IPv4bcast
+		}
+		if !dst.IP.Equal(want) || dst.Port != 3456 {
+			t.Fatal("wrong broadcast", ipnet, dst)
+		}
+		found := false
+		for _, b := range bcasts {
+			found = found || b.Equal(dst.IP)
+		}
+		if !found && !dst.IP.Equal(net.IPv4bcast) {
+			t.Fatal("subnet not found", dst)
+		}
+	}
+}
+
+func TestClientSeeds(t *testing.T) {
+	in, err := Discover(net.FlagLoopback)
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+
+	server := &Server{}
+	server.Name = "master"
+	server.PrivateKey = MasterKey
+	server.PubKeys = Keys
+	server.Interface = in
+	server.AddrVer = Ipv4
+	server.Protocol = func(addr *net.UDPAddr, req *Request) (resp *Response, err error) {
+		return &Response{Data: []byte("seed")}, nil
+	}
+	err = server.Do()
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer server.Close()
+
+	for _, seeds := range [][]string{
+		{"127.0.0.1:" + server.Port},
+		{"192.0.2.250:1", "localhost"},
+	} {
+		client := &Client{}
+		client.ServerName = "master"
+		client.ServerKey = &MasterKey.PublicKey
+		client.Name = "slave"
+		client.PrivateKey = SlaveKey
+		client.Port = server.Port
+		client.Seeds = seeds
+		client.SeedsOnly = true
+		client.Timeout = 5 * time.Second
+		client.Deadline = 500 * time.Millisecond
+		client.Request = func(dst *net.UDPAddr) (*Request, error) {
+			return &Request{}, nil
+		}
+		resp, err := client.Discover()
+		if err != nil {
+			t.Fatal(e.Trace(e.Forward(err)), seeds)
+		}
+		if string(resp.Data) != "seed" {
+			t.Fatal("wrong response", resp)
+		}
+		err = client.Close()
+		if err != nil {
+			t.Fatal(e.Trace(e.Forward(err)))
+		}
+	}
+
+	client := &Client{}
+	client.SeedsOnly = true
+	_, err = client.Discover()
+	if err == nil {
+		t.Fatal("discover without seeds")
+	}
+}
+
+func TestRelayStamp(t *testing.T) {
+	buf := bytes.NewBuffer([]byte{})
+	err := gob.NewEncoder(buf).Encode(&Msg{From: "slave", Mode: RsaMode})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r1 := &Relay{id: 1, MaxHops: 2, BufSize: 1024, Unverified: true}
+	r2 := &Relay{id: 2, MaxHops: 2, BufSize: 1024, Unverified: true}
+	r3 := &Relay{id: 3, MaxHops: 2, BufSize: 1024, Unverified: true}
+	pkt, err := r1.stamp(buf.Bytes())
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	_, err = r1.stamp(pkt)
+	if !e.Equal(err, ErrRelayLoop) {
+		t.Fatal("loop not detected", err)
+	}
+	pkt, err = r2.stamp(pkt)
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	var msg Msg
+	err = gob.NewDecoder(bytes.NewReader(pkt)).Decode(&msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Hops != 2 || len(msg.Relays) != 2 || msg.Relays[0] != 1 || msg.Relays[1] != 2 {
+		t.Fatal("wrong hops", msg.Hops, msg.Relays)
+	}
+	_, err = r3.stamp(pkt)
+	if !e.Equal(err, ErrMaxHops) {
+		t.Fatal("max hops not detected", err)
+	}
+
+	buf.Reset()
+	err = gob.NewEncoder(buf).Encode(&Msg{From: "slave", Mode: PlainMode})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = r3.stamp(buf.Bytes())
+	if err == nil {
+		t.Fatal("unauthenticated message forwarded")
+	}
+	r3.Open = true
+	_, err = r3.stamp(buf.Bytes())
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+
+	r4 := &Relay{id: 4, MaxHops: 2, BufSize: 1024, GroupKey: []byte("group secret")}
+	buf.Reset()
+	err = gob.NewEncoder(buf).Encode(&Msg{From: "slave", Mode: GroupMode, Data: [][]byte{[]byte("junk")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = r4.stamp(buf.Bytes())
+	if err == nil {
+		t.Fatal("junk forwarded")
+	}
+	buf.Reset()
+	err = gob.NewEncoder(buf).Encode(&Msg{From: "slave", Mode: RsaMode})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = r4.stamp(buf.Bytes())
+	if err == nil {
+		t.Fatal("rsa message forwarded")
+	}
+	for _, key := range []string{"wrong secret", "group secret"} {
+		gm, err := NewGroupMsg("slave", "", []byte(key), []byte("request"))
+		if err != nil {
+			t.Fatal(e.Trace(e.Forward(err)))
+		}
+		buf.Reset()
+		err = gob.NewEncoder(buf).Encode(gm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = r4.stamp(buf.Bytes())
+		if key == "wrong secret" && err == nil {
+			t.Fatal("message of other group forwarded")
+		} else if key == "group secret" && err != nil {
+			t.Fatal(e.Trace(e.Forward(err)))
+		}
+	}
+}
+
+func TestRelayRoutes(t *testing.T) {
+	r := &Relay{MaxRoutes: 2}
+	r.routes = make(map[string]*route)
+	r.closed = make(chan struct{})
+	back := func(pkt []byte) error { return nil }
+	for _, key := range []string{"a", "b", "a"} {
+		_, err := r.route(key, back)
+		if err != nil {
+			t.Fatal(e.Trace(e.Forward(err)))
+		}
+	}
+	_, err := r.route("c", back)
+	if err == nil {
+		t.Fatal("route above the maximum")
+	}
+	if len(r.routes) != 2 {
+		t.Fatal("wrong routes", len(r.routes))
+	}
+}
+
+func TestRelayClose(t *testing.T) {
+	r := &Relay{}
+	err := r.Close()
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	for _, r := range []*Relay{
+		{},
+		{In: &Server{}, Out: &Client{}},
+		{In: &Server{}, Out: &Client{}, Key: []byte("relay secret"), Peers: []string{"[::1]:-1"}, Unverified: true},
+	} {
+		err = r.Do()
+		if err == nil {
+			t.Fatal("invalid relay started")
+		}
+		for i := 0; i < 2; i++ {
+			err = r.Close()
+			if err != nil {
+				t.Fatal(e.Trace(e.Forward(err)))
+			}
+		}
+	}
+}
+
+func TestRelay(t *testing.T) {
+	in, err := Discover(net.FlagLoopback)
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+
+	server := &Server{}
+	server.Name = "master"
+	server.PrivateKey = MasterKey
+	server.PubKeys = Keys
+	server.Interface = in
+	server.AddrVer = Ipv4
+	server.Protocol = func(addr *net.UDPAddr, req *Request) (resp *Response, err error) {
+		return &Response{Data: []byte("relayed")}, nil
+	}
+	err = server.Do()
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer server.Close()
+
+	key := []byte("relay key")
+
+	// The relay near the server receives from the other relays.
+	far := &Relay{}
+	far.Key = key
+	far.Unverified = true
+	far.PeerPort = "0"
+	far.Out = &Client{}
+	far.Out.Interface = in
+	far.Out.AddrVer = Ipv4
+	far.Out.Port = server.Port
+	err = far.Do()
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer far.Close()
+
+	// The relay near the clients forwards to the server directly or to
+	// the other relay.
+	direct := &Relay{}
+	direct.In = &Server{}
+	direct.Unverified = true
+	direct.In.Interface = in
+	direct.In.AddrVer = Ipv4
+	direct.In.Port = "0"
+	direct.Out = &Client{}
+	direct.Out.Interface = in
+	direct.Out.AddrVer = Ipv4
+	direct.Out.Port = server.Port
+
+	remote := &Relay{}
+	remote.In = &Server{}
+	remote.Unverified = true
+	remote.In.Interface = in
+	remote.In.AddrVer = Ipv4
+	remote.In.Port = "0"
+	remote.Key = key
+	remote.PeerPort = "0"
+	remote.Peers = []string{"127.0.0.1:" + far.PeerPort}
+
+	for _, relay := range []*Relay{direct, remote} {
+		err = relay.Do()
+		if err != nil {
+			t.Fatal(e.Trace(e.Forward(err)))
+		}
+		defer relay.Close()
+
+		client := &Client{}
+		client.ServerName = "master"
+		client.ServerKey = &MasterKey.PublicKey
+		client.Name = "slave"
+		client.PrivateKey = SlaveKey
+		client.Interface = in
+		client.AddrVer = Ipv4
+		client.Port = relay.In.Port
+		client.Timeout = 5 * time.Second
+		client.Deadline = 500 * time.Millisecond
+		client.Request = func(dst *net.UDPAddr) (*Request, error) {
+			return &Request{}, nil
+		}
+		resp, err := client.Discover()
+		if err != nil {
+			t.Fatal(e.Trace(e.Forward(err)))
+		}
+		if string(resp.Data) != "relayed" {
+			t.Fatal("wrong response", resp)
+		}
+		if len(server.Sessions()) != 1 {
+			t.Fatal("session not found")
+		}
+		err = client.Close()
+		if err != nil {
+			t.Fatal(e.Trace(e.Forward(err)))
+		}
+		for i := 0; len(server.Sessions()) != 0; i++ {
+			if i > 50 {
+				t.Fatal("leave not relayed")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// A relay that sends back to itself drops the message.
+	free, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := strconv.Itoa(free.LocalAddr().(*net.UDPAddr).Port)
+	free.Close()
+	loop := &Relay{}
+	loop.In = &Server{}
+	loop.Unverified = true
+	loop.In.Interface = in
+	loop.In.AddrVer = Ipv4
+	loop.In.Port = port
+	loop.Out = &Client{}
+	loop.Out.Interface = in
+	loop.Out.AddrVer = Ipv4
+	loop.Out.Port = port
+	err = loop.Do()
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer loop.Close()
+
+	client := &Client{}
+	client.ServerName = "master"
+	client.ServerKey = &MasterKey.PublicKey
+	client.Name = "slave"
+	client.PrivateKey = SlaveKey
+	client.Interface = in
+	client.AddrVer = Ipv4
+	client.Port = loop.In.Port
+	client.Timeout = time.Second
+	client.Deadline = 200 * time.Millisecond
+	client.Request = func(dst *net.UDPAddr) (*Request, error) {
+		return &Request{}, nil
+	}
+	_, err = client.Discover()
+	if err == nil {
+		t.Fatal("discovered through a loop")
+	}
+}
+
 // Example demonstrate discovery in work.
 func Example() {
 	masterKey, err := rsa.GenerateKey(rand.Reader, 2048)
@@ -6,6 +6,10 @@ package discover
 
 import (
 	"net"
+	"os"
+	"path"
+	"sort"
+	"strings"
 
 	"github.com/fcavani/e"
 )
@@ -13,7 +17,27 @@ import (
 type Intface struct {
 	Interface    string
 	NotMulticast bool
-	iface        *net.Interface
+	// Include are the glob patterns of the names of the interfaces that
+	// can be selected when Interface is empty. Empty includes all.
+	Include []string
+	// Exclude are the glob patterns of the names of the interfaces never
+	// selected, like "docker*" or "veth*".
+	Exclude []string
+	// Networks are the CIDRs where the selected interfaces must have an
+	// address. Only these addresses are used by the client.
+	Networks []string
+	// Up selects only the interfaces that are up.
+	Up bool
+	// NotVirtual skips the virtual interfaces, like bridges, tunnels and
+	// the loopback.
+	NotVirtual bool
+	// Prefer are glob patterns in the order of preference. The interfaces
+	// that match the first pattern are selected first, the ones that match
+	// none are the last.
+	Prefer []string
+	iface  *net.Interface
+	// auto is true if Interface was selected by getInt.
+	auto bool
 }
 
 func (i *Intface) getInt() error {
@@ -30,22 +54,168 @@ func (i *Intface) getInt() error {
 		}
 		return e.New("none interface with this name")
 	} else if i.Interface == "" && i.iface == nil {
-		ints, err := net.Interfaces()
+		ints, err := i.candidates()
 		if err != nil {
-			return e.New(err)
+			return e.Forward(err)
 		}
 		var intName string
 		for _, in := range ints {
-			if in.Flags&net.FlagMulticast == net.FlagMulticast || in.Flags&net.FlagBroadcast == net.FlagBroadcast || in.Flags&net.FlagBroadcast == net.FlagBroadcast {
-				_, intName = getInterface(in)
+			if in.Flags&net.FlagMulticast == net.FlagMulticast || in.Flags&net.FlagBroadcast == net.FlagBroadcast {
+				_, intName = getInterface(*in)
 				if intName == "" {
 					continue
 				}
 				i.Interface = intName
-				i.iface = &in
+				i.iface = in
+				i.auto = true
 				break
 			}
 		}
 	}
 	return nil
 }
+
+// reset forgets the interface. If it was selected automatically it is
+// selected again by the next getInt.
+func (i *Intface) reset() {
+	if i.auto {
+		i.Interface = ""
+		i.auto = false
+	}
+	i.iface = nil
+}
+
+// candidates returns the interfaces allowed by the selection policy, the
+// preferred first.
+func (i *Intface) candidates() ([]*net.Interface, error) {
+	nets, err := i.networks()
+	if err != nil {
+		return nil, e.Forward(err)
+	}
+	ints, err := net.Interfaces()
+	if err != nil {
+		return nil, e.New(err)
+	}
+	cands := make([]*net.Interface, 0, len(ints))
+	for n := range ints {
+		in := &ints[n]
+		if len(i.Include) > 0 && !match(i.Include, in.Name) {
+			continue
+		}
+		if match(i.Exclude, in.Name) {
+			continue
+		}
+		if i.Up && in.Flags&net.FlagUp == 0 {
+			continue
+		}
+		if i.NotVirtual && isVirtual(in) {
+			continue
+		}
+		if len(nets) > 0 && !inNetworks(in, nets) {
+			continue
+		}
+		cands = append(cands, in)
+	}
+	sort.Stable(byPreference{cands, i.Prefer})
+	return cands, nil
+}
+
+// networks parses the Networks CIDRs.
+func (i *Intface) networks() ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(i.Networks))
+	for _, cidr := range i.Networks {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, e.Push(err, e.New("invalid network %v", cidr))
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// AddrInNetworks returns true if the ip is in one of the Networks, or if
+// Networks is empty.
+func (i *Intface) AddrInNetworks(ip string) bool {
+	if len(i.Networks) == 0 {
+		return true
+	}
+	nets, err := i.networks()
+	if err != nil {
+		return false
+	}
+	addr := net.ParseIP(ip)
+	for _, n := range nets {
+		if n.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func inNetworks(in *net.Interface, nets []*net.IPNet) bool {
+	addrs, err := in.Addrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		for _, n := range nets {
+			if n.Contains(ipnet.IP) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// match returns true if the name matches one of the glob patterns.
+func match(patterns []string, name string) bool {
+	return rank(patterns, name) < len(patterns)
+}
+
+// rank returns the index of the first pattern that matches the name or
+// the number of patterns if none matches.
+func rank(patterns []string, name string) int {
+	for i, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return i
+		}
+	}
+	return len(patterns)
+}
+
+type byPreference struct {
+	ints   []*net.Interface
+	prefer []string
+}
+
+func (b byPreference) Len() int      { return len(b.ints) }
+func (b byPreference) Swap(i, j int) { b.ints[i], b.ints[j] = b.ints[j], b.ints[i] }
+func (b byPreference) Less(i, j int) bool {
+	return rank(b.prefer, b.ints[i].Name) < rank(b.prefer, b.ints[j].Name)
+}
+
+// virtualPrefixes are the names of the usual virtual interfaces, used
+// when the system doesn't tell which interfaces are virtual.
+var virtualPrefixes = []string{"docker", "veth", "br-", "virbr", "vboxnet", "vmnet", "tun", "tap", "utun", "wg", "zt"}
+
+// isVirtual returns true if the interface isn't backed by a device.
+func isVirtual(in *net.Interface) bool {
+	if in.Flags&net.FlagLoopback == net.FlagLoopback {
+		return true
+	}
+	// In Linux the physical interfaces have a device.
+	if _, err := os.Stat("/sys/class/net/" + in.Name); err == nil {
+		_, err := os.Stat("/sys/class/net/" + in.Name + "/device")
+		return err != nil
+	}
+	for _, p := range virtualPrefixes {
+		if strings.HasPrefix(in.Name, p) {
+			return true
+		}
+	}
+	return false
+}
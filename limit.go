@@ -0,0 +1,152 @@
+// Copyright 2015 Felipe A. Cavani. All rights reserved.
+// Use of this source code is governed by the Apache License 2.0
+// license that can be found in the LICENSE file.
+
+package discover
+
+import (
+	"sync"
+	"time"
+)
+
+// bucket is a token bucket.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// limiter keeps one token bucket for each key.
+type limiter struct {
+	rate    float64
+	burst   float64
+	buckets map[string]*bucket
+	sweep   time.Time
+	lck     sync.Mutex
+}
+
+// newLimiter creates a limiter that allows rate messages per second, with
+// bursts of burst messages.
+func newLimiter(rate float64, burst int) *limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &limiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+		sweep:   time.Now(),
+	}
+}
+
+// Allow takes one token from the bucket of key and returns false if there
+// isn't one.
+func (l *limiter) Allow(key string) bool {
+	l.lck.Lock()
+	defer l.lck.Unlock()
+	now := time.Now()
+	// The buckets that are full again are the same as new buckets.
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	if now.Sub(l.sweep) > full {
+		for k, b := range l.buckets {
+			if now.Sub(b.last) > full {
+				delete(l.buckets, k)
+			}
+		}
+		l.sweep = now
+	}
+	b, found := l.buckets[key]
+	if !found {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// failures are the failures of one address since first.
+type failures struct {
+	count int
+	first time.Time
+}
+
+// banList bans the addresses that fail the authentication too many times.
+type banList struct {
+	max      int
+	duration time.Duration
+	fails    map[string]*failures
+	banned   map[string]time.Time
+	sweep    time.Time
+	lck      sync.Mutex
+}
+
+// newBanList creates a ban list that bans for duration the addresses with
+// max failures within duration.
+func newBanList(max int, duration time.Duration) *banList {
+	return &banList{
+		max:      max,
+		duration: duration,
+		fails:    make(map[string]*failures),
+		banned:   make(map[string]time.Time),
+		sweep:    time.Now(),
+	}
+}
+
+// Banned returns true if the address is banned.
+func (b *banList) Banned(addr string) bool {
+	b.lck.Lock()
+	defer b.lck.Unlock()
+	until, found := b.banned[addr]
+	if !found {
+		return false
+	}
+	if time.Now().After(until) {
+		delete(b.banned, addr)
+		return false
+	}
+	return true
+}
+
+// Fail records one failure of the address and returns true if the address
+// was banned by it.
+func (b *banList) Fail(addr string) bool {
+	b.lck.Lock()
+	defer b.lck.Unlock()
+	now := time.Now()
+	// The old entries are removed once in each period, not in each call.
+	if now.Sub(b.sweep) > b.duration {
+		for a, f := range b.fails {
+			if now.Sub(f.first) > b.duration {
+				delete(b.fails, a)
+			}
+		}
+		for a, until := range b.banned {
+			if now.After(until) {
+				delete(b.banned, a)
+			}
+		}
+		b.sweep = now
+	}
+	f, found := b.fails[addr]
+	if found && now.Sub(f.first) > b.duration {
+		found = false
+	}
+	if !found {
+		f = &failures{first: now}
+		b.fails[addr] = f
+	}
+	f.count++
+	if f.count < b.max {
+		return false
+	}
+	delete(b.fails, addr)
+	b.banned[addr] = now.Add(b.duration)
+	return true
+}
@@ -0,0 +1,334 @@
+// Copyright 2015 Felipe A. Cavani. All rights reserved.
+// Use of this source code is governed by the Apache License 2.0
+// license that can be found in the LICENSE file.
+
+package discover
+
+import (
+	"hash/fnv"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fcavani/e"
+	"github.com/fcavani/log"
+)
+
+// listener is the socket of the server in one interface and group. The
+// interfaces without multicast share the same socket. As the sockets are
+// bound to the same port a packet may arrive in the socket of other
+// interface, so it is handled by the listener of the interface that owns
+// the client address.
+type listener struct {
+	iface *net.Interface
+	conn  *net.UDPConn
+	nets  []*net.IPNet
+	// ver is the ip version of the addresses served by the socket.
+	ver AddrVer
+}
+
+// Name returns the name of the interface.
+func (l *listener) Name() string {
+	return l.iface.Name
+}
+
+// owns returns true if the address is reachable directly by the interface
+// and is of the version of the socket.
+func (l *listener) owns(addr *net.UDPAddr) bool {
+	if !l.ver.AddrAllowed(addr.IP.String()) {
+		return false
+	}
+	if addr.Zone != "" {
+		return addr.Zone == l.iface.Name
+	}
+	for _, n := range l.nets {
+		if n.Contains(addr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// interfaces returns the interfaces where the server listens.
+func (a *Server) interfaces() ([]*net.Interface, error) {
+	if a.AllInterfaces {
+		ints, err := a.candidates()
+		if err != nil {
+			return nil, e.Forward(err)
+		}
+		ifaces := make([]*net.Interface, 0, len(ints))
+		for _, in := range ints {
+			if in.Flags&net.FlagUp == 0 || !hasAddr(in, a.AddrVer) {
+				continue
+			}
+			ifaces = append(ifaces, in)
+		}
+		if len(ifaces) == 0 {
+			return nil, e.New(ErrNoInt)
+		}
+		return ifaces, nil
+	}
+	if len(a.Interfaces) > 0 {
+		ifaces := make([]*net.Interface, 0, len(a.Interfaces))
+		for _, name := range a.Interfaces {
+			in, err := net.InterfaceByName(name)
+			if err != nil {
+				return nil, e.Push(err, e.New("none interface with this name: %v", name))
+			}
+			ifaces = append(ifaces, in)
+		}
+		return ifaces, nil
+	}
+	err := a.getInt()
+	if err != nil {
+		return nil, e.Forward(err)
+	}
+	if a.iface == nil {
+		return nil, e.New(ErrNoInt)
+	}
+	return []*net.Interface{a.iface}, nil
+}
+
+// hasAddr returns true if the interface has one address of the ip version.
+func hasAddr(in *net.Interface, ver AddrVer) bool {
+	addrs, err := in.Addrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if ok && ver.AddrAllowed(ipnet.IP.String()) {
+			return true
+		}
+	}
+	return false
+}
+
+// listen binds one socket for each interface and group.
+func (a *Server) listen() ([]*listener, error) {
+	ifaces, err := a.interfaces()
+	if err != nil {
+		return nil, e.Forward(err)
+	}
+	var lns []*listener
+	var shared *net.UDPConn
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			closeAll(lns)
+			return nil, e.New(err)
+		}
+		var nets []*net.IPNet
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok {
+				nets = append(nets, ipnet)
+			}
+		}
+		if a.NotMulticast || iface.Flags&net.FlagMulticast == 0 {
+			// All interfaces without multicast receive the broadcasts
+			// in the same socket.
+			if shared == nil {
+				shared, err = a.bind(iface, nil)
+				if err != nil {
+					closeAll(lns)
+					return nil, e.Forward(err)
+				}
+			}
+			ln := &listener{iface: iface, conn: shared, nets: nets, ver: a.AddrVer}
+			log.ProtoLevel().Tag("server", "discover").Printf("Listen in %v (%v).", iface.Name, ln.conn.LocalAddr())
+			lns = append(lns, ln)
+			continue
+		}
+		gaddrs, err := a.groupAddrs(iface)
+		if a.AllInterfaces && err != nil {
+			log.Tag("discover", "server").Printf("Can't listen in %v: %v", iface.Name, err)
+			continue
+		} else if err != nil {
+			closeAll(lns)
+			return nil, e.Forward(err)
+		}
+		for _, gaddr := range gaddrs {
+			ln := &listener{iface: iface, nets: nets, ver: Ipv4}
+			if gaddr.IP.To4() == nil {
+				ln.ver = Ipv6
+			}
+			// The port may be chosen by the first bind.
+			gaddr.Port, err = strconv.Atoi(a.Port)
+			if err != nil {
+				closeAll(lns)
+				return nil, e.New(err)
+			}
+			ln.conn, err = a.bind(iface, gaddr)
+			if a.AllInterfaces && err != nil {
+				log.Tag("discover", "server").Printf("Can't listen in %v: %v", iface.Name, err)
+				continue
+			} else if err != nil {
+				closeAll(lns)
+				return nil, e.Forward(err)
+			}
+			log.ProtoLevel().Tag("server", "discover").Printf("Listen in %v, group %v (%v).", iface.Name, gaddr, ln.conn.LocalAddr())
+			lns = append(lns, ln)
+		}
+	}
+	if len(lns) == 0 {
+		return nil, e.New(ErrNoInt)
+	}
+	return lns, nil
+}
+
+// conns returns the sockets of the listeners, each one only once.
+func conns(lns []*listener) []*net.UDPConn {
+	conns := make([]*net.UDPConn, 0, len(lns))
+	seen := make(map[*net.UDPConn]bool)
+	for _, ln := range lns {
+		if seen[ln.conn] {
+			continue
+		}
+		seen[ln.conn] = true
+		conns = append(conns, ln.conn)
+	}
+	return conns
+}
+
+func closeAll(lns []*listener) error {
+	var err error
+	for _, conn := range conns(lns) {
+		er := conn.Close()
+		if er != nil && err == nil {
+			err = e.New(er)
+		}
+	}
+	return err
+}
+
+// serveAll starts to serve with the listeners, in the place of the old ones.
+func (a *Server) serveAll(lns []*listener) {
+	a.lckListeners.Lock()
+	a.listeners = lns
+	a.lckListeners.Unlock()
+	for _, conn := range conns(lns) {
+		go a.serve(conn)
+	}
+}
+
+// closeListeners closes the sockets of the server.
+func (a *Server) closeListeners() error {
+	a.lckListeners.Lock()
+	lns := a.listeners
+	a.listeners = nil
+	a.lckListeners.Unlock()
+	return closeAll(lns)
+}
+
+// listener returns the listener of the interface that owns the address,
+// or the first listener of conn if none owns it.
+func (a *Server) listener(conn *net.UDPConn, addr *net.UDPAddr) *listener {
+	a.lckListeners.RLock()
+	defer a.lckListeners.RUnlock()
+	var first *listener
+	for _, ln := range a.listeners {
+		if ln.owns(addr) {
+			return ln
+		}
+		if first == nil && ln.conn == conn {
+			first = ln
+		}
+	}
+	return first
+}
+
+// route returns the listener used to send to addr, when it isn't an answer
+// to a received packet.
+func (a *Server) route(addr *net.UDPAddr) *listener {
+	ln := a.listener(nil, addr)
+	if ln != nil {
+		return ln
+	}
+	a.lckListeners.RLock()
+	defer a.lckListeners.RUnlock()
+	if len(a.listeners) == 0 {
+		return nil
+	}
+	return a.listeners[0]
+}
+
+// dupWindow is the time that a packet is remembered to detect its copies.
+const dupWindow = time.Second
+
+// dups detects the copies of one multicast packet received by the sockets
+// of many interfaces. A packet repeated in the same socket is a new
+// packet, like a retransmission.
+type dups struct {
+	seen  map[uint64]*sighting
+	sweep time.Time
+	lck   sync.Mutex
+}
+
+type sighting struct {
+	conn *net.UDPConn
+	at   time.Time
+}
+
+func newDups() *dups {
+	return &dups{
+		seen:  make(map[uint64]*sighting),
+		sweep: time.Now(),
+	}
+}
+
+// Dup returns true if the packet was already received by other socket.
+func (d *dups) Dup(conn *net.UDPConn, addr *net.UDPAddr, pkt []byte) bool {
+	h := fnv.New64a()
+	h.Write([]byte(addr.String()))
+	h.Write(pkt)
+	key := h.Sum64()
+	d.lck.Lock()
+	defer d.lck.Unlock()
+	now := time.Now()
+	if now.Sub(d.sweep) > dupWindow {
+		for k, s := range d.seen {
+			if now.Sub(s.at) > dupWindow {
+				delete(d.seen, k)
+			}
+		}
+		d.sweep = now
+	}
+	s, found := d.seen[key]
+	if found && s.conn != conn && now.Sub(s.at) <= dupWindow {
+		return true
+	}
+	d.seen[key] = &sighting{conn: conn, at: now}
+	return false
+}
+
+// groupAddrs returns the groups joined in the interface. In dual stack
+// mode these are the groups of both ip versions that the interface has.
+func (a *Server) groupAddrs(iface *net.Interface) ([]*net.UDPAddr, error) {
+	if !a.DualStack {
+		gaddr, err := a.groupAddr(iface)
+		if err != nil {
+			return nil, e.Forward(err)
+		}
+		return []*net.UDPAddr{gaddr}, nil
+	}
+	gaddrs := make([]*net.UDPAddr, 0, 2)
+	if hasAddr(iface, Ipv4) {
+		gaddr, err := net.ResolveUDPAddr("udp4", a.McIpv4+":"+a.Port)
+		if err != nil {
+			return nil, e.New(err)
+		}
+		gaddrs = append(gaddrs, gaddr)
+	}
+	if hasAddr(iface, Ipv6) {
+		gaddr, err := net.ResolveUDPAddr("udp6", a.McIpv6+":"+a.Port)
+		if err != nil {
+			return nil, e.New(err)
+		}
+		gaddrs = append(gaddrs, gaddr)
+	}
+	if len(gaddrs) == 0 {
+		return nil, e.New("no valid ip address")
+	}
+	return gaddrs, nil
+}
@@ -6,18 +6,60 @@ package discover
 
 import (
 	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 
 	"github.com/fcavani/e"
 )
 
+// MsgMode tells how the data in a message is protected.
+type MsgMode uint8
+
+const (
+	// RsaMode encrypts and signs the data with the peers RSA keys.
+	RsaMode MsgMode = iota
+	// GroupMode encrypts and authenticates the data with a pre-shared group key.
+	GroupMode
+	// SignedMode only signs the data with the sender private key.
+	SignedMode
+	// PlainMode sends the data as is.
+	PlainMode
+)
+
+func (m MsgMode) String() string {
+	switch m {
+	case RsaMode:
+		return "rsa"
+	case GroupMode:
+		return "group"
+	case SignedMode:
+		return "signed"
+	case PlainMode:
+		return "plain"
+	default:
+		return "invalid"
+	}
+}
+
 type Msg struct {
 	From      string
 	To        string
+	Mode      MsgMode
+	Nonce     []byte
 	Data      [][]byte
 	Signature [][]byte
-	Err       error
+	// Cookie is the stateless cookie given by the server. It is echoed by
+	// the client in the next messages.
+	Cookie []byte
+	// Hops is the number of relays that forwarded the message and Relays
+	// are their ids. They aren't authenticated.
+	Hops   int
+	Relays []uint64
+	Err    error
 }
 
 func NewMsg(from, to string, fromkey *rsa.PrivateKey, tokey *rsa.PublicKey, data []byte) (*Msg, error) {
@@ -82,3 +124,133 @@ func (m *Msg) Message(fromkey *rsa.PublicKey, dstkey *rsa.PrivateKey) (data []by
 	}
 	return data, nil
 }
+
+// groupCipher derives the AEAD from the group key. The key is never used
+// directly, it is first passed through a HMAC-SHA256.
+func groupCipher(key []byte) (cipher.AEAD, error) {
+	if len(key) == 0 {
+		return nil, e.New("empty group key")
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("discover group key"))
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, e.New(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, e.New(err)
+	}
+	return aead, nil
+}
+
+// header is the additional data authenticated with the message.
+func header(from, to string) []byte {
+	return []byte(from + "\x00" + to)
+}
+
+// NewGroupMsg creates a message encrypted and authenticated with a pre-shared key.
+func NewGroupMsg(from, to string, key []byte, data []byte) (*Msg, error) {
+	aead, err := groupCipher(key)
+	if err != nil {
+		return nil, e.Forward(err)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, e.Push(err, "can't create the nonce")
+	}
+	return &Msg{
+		From:  from,
+		To:    to,
+		Mode:  GroupMode,
+		Nonce: nonce,
+		Data:  [][]byte{aead.Seal(nil, nonce, data, header(from, to))},
+	}, nil
+}
+
+// GroupMessage verifies and decrypts a message created by NewGroupMsg.
+func (m *Msg) GroupMessage(key []byte) ([]byte, error) {
+	if m.Mode != GroupMode {
+		return nil, e.New("message isn't in group mode")
+	}
+	if len(m.Data) != 1 {
+		return nil, e.New("invalid group message")
+	}
+	aead, err := groupCipher(key)
+	if err != nil {
+		return nil, e.Forward(err)
+	}
+	if len(m.Nonce) != aead.NonceSize() {
+		return nil, e.New("invalid nonce")
+	}
+	data, err := aead.Open(nil, m.Nonce, m.Data[0], header(m.From, m.To))
+	if err != nil {
+		return nil, e.Push(err, "can't decrypt the message")
+	}
+	return data, nil
+}
+
+// NewSignedMsg creates a message with the data in clear, signed by the sender.
+func NewSignedMsg(from, to string, fromkey *rsa.PrivateKey, data []byte) (*Msg, error) {
+	hash := crypto.SHA256
+	pssh := hash.New()
+	pssh.Write(header(from, to))
+	pssh.Write(data)
+	var opts rsa.PSSOptions
+	opts.SaltLength = rsa.PSSSaltLengthAuto
+	signature, err := rsa.SignPSS(rand.Reader, fromkey, hash, pssh.Sum(nil), &opts)
+	if err != nil {
+		return nil, e.Push(err, "can't sign the message")
+	}
+	return &Msg{
+		From:      from,
+		To:        to,
+		Mode:      SignedMode,
+		Data:      [][]byte{data},
+		Signature: [][]byte{signature},
+	}, nil
+}
+
+// SignedMessage verifies the signature of a message created by NewSignedMsg
+// and returns the data.
+func (m *Msg) SignedMessage(fromkey *rsa.PublicKey) ([]byte, error) {
+	if m.Mode != SignedMode {
+		return nil, e.New("message isn't signed")
+	}
+	if len(m.Data) != 1 || len(m.Signature) != 1 {
+		return nil, e.New("invalid signed message")
+	}
+	hash := crypto.SHA256
+	pssh := hash.New()
+	pssh.Write(header(m.From, m.To))
+	pssh.Write(m.Data[0])
+	var opts rsa.PSSOptions
+	opts.SaltLength = rsa.PSSSaltLengthAuto
+	err := rsa.VerifyPSS(fromkey, hash, pssh.Sum(nil), m.Signature[0], &opts)
+	if err != nil {
+		return nil, e.Push(err, "can't verify the signature")
+	}
+	return m.Data[0], nil
+}
+
+// NewPlainMsg creates a message without any protection.
+func NewPlainMsg(from, to string, data []byte) *Msg {
+	return &Msg{
+		From: from,
+		To:   to,
+		Mode: PlainMode,
+		Data: [][]byte{data},
+	}
+}
+
+// PlainMessage returns the data of a message created by NewPlainMsg.
+func (m *Msg) PlainMessage() ([]byte, error) {
+	if m.Mode != PlainMode {
+		return nil, e.New("message isn't plain")
+	}
+	if len(m.Data) != 1 {
+		return nil, e.New("invalid plain message")
+	}
+	return m.Data[0], nil
+}
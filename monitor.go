@@ -0,0 +1,274 @@
+// Copyright 2015 Felipe A. Cavani. All rights reserved.
+// Use of this source code is governed by the Apache License 2.0
+// license that can be found in the LICENSE file.
+
+package discover
+
+import (
+	"net"
+	"sort"
+	"time"
+
+	"github.com/fcavani/e"
+	"github.com/fcavani/log"
+)
+
+// NetEventType is the kind of change in the network.
+type NetEventType uint8
+
+const (
+	// IntUp is an interface that appeared or came up.
+	IntUp NetEventType = iota
+	// IntDown is an interface that was removed or went down.
+	IntDown
+	// AddrAdded is a new address in an interface.
+	AddrAdded
+	// AddrRemoved is an address removed from an interface.
+	AddrRemoved
+	// Rebound tells that the server listens again after the changes.
+	Rebound
+	// RebindFailed tells that the server can't listen after the changes,
+	// the server tries again in the next change.
+	RebindFailed
+)
+
+func (n NetEventType) String() string {
+	switch n {
+	case IntUp:
+		return "interface up"
+	case IntDown:
+		return "interface down"
+	case AddrAdded:
+		return "address added"
+	case AddrRemoved:
+		return "address removed"
+	case Rebound:
+		return "rebound"
+	case RebindFailed:
+		return "rebind failed"
+	default:
+		return "invalid"
+	}
+}
+
+// NetEvent is a change in the network seen by the server.
+type NetEvent struct {
+	Type NetEventType
+	// Interface is the name of the interface that changed.
+	Interface string
+	// Addr is the address added or removed.
+	Addr string
+	// Err is the error of RebindFailed.
+	Err error
+}
+
+// netState is the state of one interface.
+type netState struct {
+	up    bool
+	addrs map[string]bool
+}
+
+// snapshot returns the state of all interfaces.
+func snapshot() (map[string]*netState, error) {
+	ints, err := net.Interfaces()
+	if err != nil {
+		return nil, e.New(err)
+	}
+	states := make(map[string]*netState, len(ints))
+	for _, in := range ints {
+		st := &netState{
+			up:    in.Flags&net.FlagUp == net.FlagUp,
+			addrs: make(map[string]bool),
+		}
+		addrs, err := in.Addrs()
+		if err == nil {
+			for _, addr := range addrs {
+				st.addrs[addr.String()] = true
+			}
+		}
+		states[in.Name] = st
+	}
+	return states, nil
+}
+
+// changes returns the events that turn old into cur, ordered by interface.
+func changes(old, cur map[string]*netState) []NetEvent {
+	names := make([]string, 0, len(cur))
+	for name := range cur {
+		names = append(names, name)
+	}
+	for name := range old {
+		if _, found := cur[name]; !found {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	events := make([]NetEvent, 0)
+	for _, name := range names {
+		o, c := old[name], cur[name]
+		if o == nil {
+			o = &netState{addrs: map[string]bool{}}
+		}
+		if c == nil {
+			c = &netState{addrs: map[string]bool{}}
+		}
+		if !o.up && c.up {
+			events = append(events, NetEvent{Type: IntUp, Interface: name})
+		} else if o.up && !c.up {
+			events = append(events, NetEvent{Type: IntDown, Interface: name})
+		}
+		for _, addr := range sortedAddrs(c.addrs) {
+			if !o.addrs[addr] {
+				events = append(events, NetEvent{Type: AddrAdded, Interface: name, Addr: addr})
+			}
+		}
+		for _, addr := range sortedAddrs(o.addrs) {
+			if !c.addrs[addr] {
+				events = append(events, NetEvent{Type: AddrRemoved, Interface: name, Addr: addr})
+			}
+		}
+	}
+	return events
+}
+
+func sortedAddrs(addrs map[string]bool) []string {
+	s := make([]string, 0, len(addrs))
+	for addr := range addrs {
+		s = append(s, addr)
+	}
+	sort.Strings(s)
+	return s
+}
+
+// watcher signals when the network may have changed. It polls in an
+// interval and, where it is available, listens to the kernel
+// notifications.
+type watcher struct {
+	C    chan struct{}
+	done chan struct{}
+}
+
+func newWatcher(interval time.Duration) *watcher {
+	w := &watcher{
+		C:    make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+	err := watchNetlink(w.signal, w.done)
+	if err != nil {
+		log.ProtoLevel().Tag("server", "discover").Printf("Network notifications not available, polling every %v: %v", interval, err)
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				w.signal()
+			case <-w.done:
+				return
+			}
+		}
+	}()
+	return w
+}
+
+func (w *watcher) signal() {
+	select {
+	case w.C <- struct{}{}:
+	default:
+	}
+}
+
+func (w *watcher) Close() {
+	close(w.done)
+}
+
+// monitor listens again when the interfaces used by the server change.
+func (a *Server) monitor(w *watcher, states map[string]*netState) {
+	for {
+		select {
+		case <-w.C:
+		case <-w.done:
+			return
+		}
+		cur, err := snapshot()
+		if err != nil {
+			log.Tag("discover", "server").Printf("Can't read the network state: %v", err)
+			continue
+		}
+		events := make([]NetEvent, 0)
+		for _, ev := range changes(states, cur) {
+			if a.watches(ev.Interface) {
+				events = append(events, ev)
+			}
+		}
+		states = cur
+		if len(events) == 0 {
+			continue
+		}
+		for _, ev := range events {
+			log.ProtoLevel().Tag("server", "discover").Printf("Network change: %v %v %v", ev.Type, ev.Interface, ev.Addr)
+			a.netEvent(ev)
+		}
+		err = a.rebind()
+		if err != nil {
+			log.Tag("discover", "server").Printf("Can't listen again: %v", err)
+			a.netEvent(NetEvent{Type: RebindFailed, Err: err})
+			continue
+		}
+		a.netEvent(NetEvent{Type: Rebound})
+	}
+}
+
+// watches returns true if the changes in the interface concern the server.
+func (a *Server) watches(name string) bool {
+	a.lckListeners.RLock()
+	for _, ln := range a.listeners {
+		if ln.Name() == name {
+			a.lckListeners.RUnlock()
+			return true
+		}
+	}
+	a.lckListeners.RUnlock()
+	// The interface selected automatically may be replaced by other.
+	if a.AllInterfaces || a.auto {
+		ints, err := a.candidates()
+		if err != nil {
+			return false
+		}
+		for _, in := range ints {
+			if in.Name == name {
+				return true
+			}
+		}
+		return false
+	}
+	if len(a.Interfaces) > 0 {
+		return match(a.Interfaces, name)
+	}
+	return a.Interface == name
+}
+
+// rebind closes the sockets and listens again in the interfaces, that are
+// resolved again.
+func (a *Server) rebind() error {
+	a.lckBind.Lock()
+	defer a.lckBind.Unlock()
+	if a.closed {
+		return e.New("server closed")
+	}
+	a.closeListeners()
+	a.reset()
+	lns, err := a.listen()
+	if err != nil {
+		return e.Forward(err)
+	}
+	a.serveAll(lns)
+	return nil
+}
+
+func (a *Server) netEvent(ev NetEvent) {
+	if a.OnNetEvent != nil {
+		a.OnNetEvent(ev)
+	}
+}
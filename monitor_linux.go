@@ -0,0 +1,60 @@
+// Copyright 2015 Felipe A. Cavani. All rights reserved.
+// Use of this source code is governed by the Apache License 2.0
+// license that can be found in the LICENSE file.
+
+package discover
+
+import (
+	"syscall"
+
+	"github.com/fcavani/e"
+)
+
+// The netlink groups of the link and address notifications.
+const (
+	rtmgrpLink       = 0x1
+	rtmgrpIpv4Ifaddr = 0x10
+	rtmgrpIpv6Ifaddr = 0x100
+)
+
+// watchNetlink calls signal for each link or address notification of the
+// kernel, until done is closed.
+func watchNetlink(signal func(), done <-chan struct{}) error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return e.New(err)
+	}
+	sa := &syscall.SockaddrNetlink{
+		Family: syscall.AF_NETLINK,
+		Groups: rtmgrpLink | rtmgrpIpv4Ifaddr | rtmgrpIpv6Ifaddr,
+	}
+	err = syscall.Bind(fd, sa)
+	if err != nil {
+		syscall.Close(fd)
+		return e.New(err)
+	}
+	// The timeout lets the loop see done.
+	tv := syscall.Timeval{Sec: 1}
+	err = syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv)
+	if err != nil {
+		syscall.Close(fd)
+		return e.New(err)
+	}
+	go func() {
+		defer syscall.Close(fd)
+		buf := make([]byte, syscall.Getpagesize())
+		for {
+			n, _, err := syscall.Recvfrom(fd, buf, 0)
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if err != nil || n <= 0 {
+				continue
+			}
+			signal()
+		}
+	}()
+	return nil
+}
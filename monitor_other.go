@@ -0,0 +1,17 @@
+// Copyright 2015 Felipe A. Cavani. All rights reserved.
+// Use of this source code is governed by the Apache License 2.0
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package discover
+
+import (
+	"github.com/fcavani/e"
+)
+
+// watchNetlink isn't available outside Linux, the server only polls.
+func watchNetlink(signal func(), done <-chan struct{}) error {
+	return e.New("netlink isn't available")
+}
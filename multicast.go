@@ -0,0 +1,131 @@
+// Copyright 2015 Felipe A. Cavani. All rights reserved.
+// Use of this source code is governed by the Apache License 2.0
+// license that can be found in the LICENSE file.
+
+package discover
+
+import (
+	gocontext "context"
+	"net"
+
+	"github.com/fcavani/e"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// tune sets the multicast options of the client socket that sends to the
+// group. iface is the interface of the socket.
+func (m *MulticastAddr) tune(conn *net.UDPConn, iface *net.Interface, group net.IP) error {
+	out := iface
+	if m.McInterface != "" {
+		in, err := net.InterfaceByName(m.McInterface)
+		if err != nil {
+			return e.Push(err, ErrCantFindInt)
+		}
+		out = in
+	}
+	if group.To4() != nil {
+		p := ipv4.NewPacketConn(conn)
+		if m.McTTL > 0 {
+			err := p.SetMulticastTTL(m.McTTL)
+			if err != nil {
+				return e.New(err)
+			}
+		}
+		err := p.SetMulticastLoopback(!m.McNoLoop)
+		if err != nil {
+			return e.New(err)
+		}
+		if out != nil {
+			err = p.SetMulticastInterface(out)
+			if err != nil {
+				return e.New(err)
+			}
+		}
+		return nil
+	}
+	p := ipv6.NewPacketConn(conn)
+	if m.McTTL > 0 {
+		err := p.SetMulticastHopLimit(m.McTTL)
+		if err != nil {
+			return e.New(err)
+		}
+	}
+	err := p.SetMulticastLoopback(!m.McNoLoop)
+	if err != nil {
+		return e.New(err)
+	}
+	if out != nil {
+		err = p.SetMulticastInterface(out)
+		if err != nil {
+			return e.New(err)
+		}
+	}
+	return nil
+}
+
+// ErrNoSources is returned when no source is of the version of the group.
+const ErrNoSources = "no source for the group"
+
+// sources returns the designated sources of the version of group.
+func (m *MulticastAddr) sources(group net.IP) ([]net.IP, error) {
+	var ips []net.IP
+	for _, s := range m.McSources {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, e.New("invalid source address: %v", s)
+		}
+		if (ip.To4() == nil) != (group.To4() == nil) {
+			continue
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+// isSource returns true if the client can send from addr. Without
+// McSources all addresses can.
+func (m *MulticastAddr) isSource(addr string) bool {
+	if len(m.McSources) == 0 {
+		return true
+	}
+	ip := net.ParseIP(addr)
+	for _, s := range m.McSources {
+		if ip.Equal(net.ParseIP(s)) {
+			return true
+		}
+	}
+	return false
+}
+
+// listenSources creates a socket in gaddr and joins the source-specific
+// group of each source.
+func (m *MulticastAddr) listenSources(proto string, iface *net.Interface, gaddr *net.UDPAddr) (*net.UDPConn, error) {
+	srcs, err := m.sources(gaddr.IP)
+	if err != nil {
+		return nil, e.Forward(err)
+	}
+	if len(srcs) == 0 {
+		return nil, e.New(ErrNoSources)
+	}
+	lc := net.ListenConfig{Control: reuseAddr}
+	pc, err := lc.ListenPacket(gocontext.Background(), proto, gaddr.String())
+	if err != nil {
+		return nil, e.New(err)
+	}
+	conn := pc.(*net.UDPConn)
+	group := &net.UDPAddr{IP: gaddr.IP}
+	for _, src := range srcs {
+		source := &net.UDPAddr{IP: src}
+		if gaddr.IP.To4() != nil {
+			err = ipv4.NewPacketConn(conn).JoinSourceSpecificGroup(iface, group, source)
+		} else {
+			err = ipv6.NewPacketConn(conn).JoinSourceSpecificGroup(iface, group, source)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, e.New(err)
+		}
+	}
+	return conn, nil
+}
@@ -0,0 +1,82 @@
+// Copyright 2015 Felipe A. Cavani. All rights reserved.
+// Use of this source code is governed by the Apache License 2.0
+// license that can be found in the LICENSE file.
+
+package discover
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// phiWindow is the number of keepalive intervals used to estimate the
+// distribution of the arrivals.
+const phiWindow = 100
+
+// phi is a phi accrual failure detector. It is feed with the arrival
+// times of the keepalives and gives the suspicion level that the client
+// is dead. Phi of 1 means a chance of 10% of mistake, 2 means 1%, 3 means
+// 0.1% and so on.
+type phi struct {
+	lck       sync.Mutex
+	intervals []float64
+	next      int
+	last      time.Time
+	pause     time.Duration
+	minStdDev float64
+}
+
+// newPhi creates the detector. The history is initialized with the expected
+// keepalive interval. Pause is the time that the client can stay silent,
+// beyond the mean interval, before the suspicion begins to grow.
+func newPhi(expected, pause time.Duration) *phi {
+	mean := float64(expected)
+	std := mean / 4
+	return &phi{
+		intervals: []float64{mean - std, mean + std},
+		last:      time.Now(),
+		pause:     pause,
+		minStdDev: mean / 10,
+	}
+}
+
+// Heartbeat records the arrival of one keepalive.
+func (p *phi) Heartbeat(t time.Time) {
+	p.lck.Lock()
+	defer p.lck.Unlock()
+	interval := float64(t.Sub(p.last))
+	p.last = t
+	if len(p.intervals) < phiWindow {
+		p.intervals = append(p.intervals, interval)
+		return
+	}
+	p.intervals[p.next] = interval
+	p.next = (p.next + 1) % phiWindow
+}
+
+// Phi returns the suspicion level at the time t.
+func (p *phi) Phi(t time.Time) float64 {
+	p.lck.Lock()
+	defer p.lck.Unlock()
+	var sum, sq float64
+	for _, i := range p.intervals {
+		sum += i
+		sq += i * i
+	}
+	n := float64(len(p.intervals))
+	mean := sum / n
+	std := math.Sqrt(math.Max(sq/n-mean*mean, 0))
+	if std < p.minStdDev {
+		std = p.minStdDev
+	}
+	mean += float64(p.pause)
+	diff := float64(t.Sub(p.last))
+	// Logistic approximation of the normal cumulative distribution.
+	y := (diff - mean) / std
+	ex := math.Exp(-y * (1.5976 + 0.070566*y*y))
+	if diff > mean {
+		return -math.Log10(ex / (1 + ex))
+	}
+	return -math.Log10(1 - 1/(1+ex))
+}
@@ -0,0 +1,133 @@
+// Copyright 2015 Felipe A. Cavani. All rights reserved.
+// Use of this source code is governed by the Apache License 2.0
+// license that can be found in the LICENSE file.
+
+package discover
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// Overflow tells what the server does when the queue of a worker is full.
+type Overflow uint8
+
+const (
+	// DropNewest drops the packet just received. This is the default.
+	DropNewest Overflow = iota
+	// DropOldest drops the oldest packet in the queue.
+	DropOldest
+	// Block stops reading from the network until the worker catches up.
+	Block
+)
+
+func (o Overflow) String() string {
+	switch o {
+	case DropNewest:
+		return "drop newest"
+	case DropOldest:
+		return "drop oldest"
+	case Block:
+		return "block"
+	default:
+		return "invalid"
+	}
+}
+
+// job is run by a worker. If the job is dropped, drop is called instead.
+type job struct {
+	run  func()
+	drop func()
+}
+
+// pool is a fixed set of workers, each one with its own queue. The jobs
+// with the same key are always run by the same worker, in order.
+type pool struct {
+	queues []chan *job
+	policy Overflow
+	closed bool
+	lck    sync.RWMutex
+	wg     sync.WaitGroup
+}
+
+func newPool(workers, size int, policy Overflow) *pool {
+	p := &pool{
+		queues: make([]chan *job, workers),
+		policy: policy,
+	}
+	for i := range p.queues {
+		p.queues[i] = make(chan *job, size)
+		p.wg.Add(1)
+		go func(queue chan *job) {
+			defer p.wg.Done()
+			for j := range queue {
+				j.run()
+			}
+		}(p.queues[i])
+	}
+	return p
+}
+
+// Submit queues the job in the worker of key. Drop may be nil. It returns
+// false if the job, or other job from the queue, was dropped.
+func (p *pool) Submit(key string, run, drop func()) bool {
+	j := &job{run: run, drop: drop}
+	p.lck.RLock()
+	defer p.lck.RUnlock()
+	if p.closed {
+		j.dropped()
+		return false
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	queue := p.queues[h.Sum32()%uint32(len(p.queues))]
+	switch p.policy {
+	case Block:
+		queue <- j
+		return true
+	case DropOldest:
+		ok := true
+		for {
+			select {
+			case queue <- j:
+				return ok
+			default:
+			}
+			select {
+			case old := <-queue:
+				old.dropped()
+				ok = false
+			default:
+			}
+		}
+	default:
+		select {
+		case queue <- j:
+			return true
+		default:
+			j.dropped()
+			return false
+		}
+	}
+}
+
+func (j *job) dropped() {
+	if j.drop != nil {
+		j.drop()
+	}
+}
+
+// Close waits the workers to finish the queued jobs and stops them.
+func (p *pool) Close() {
+	p.lck.Lock()
+	if p.closed {
+		p.lck.Unlock()
+		return
+	}
+	p.closed = true
+	for _, queue := range p.queues {
+		close(queue)
+	}
+	p.lck.Unlock()
+	p.wg.Wait()
+}
@@ -0,0 +1,296 @@
+// Copyright 2015 Felipe A. Cavani. All rights reserved.
+// Use of this source code is governed by the Apache License 2.0
+// license that can be found in the LICENSE file.
+
+package discover
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fcavani/e"
+	"github.com/fcavani/log"
+	utilNet "github.com/fcavani/net"
+)
+
+// ErrProbeLost is returned by the probes that lost the race for the server.
+const ErrProbeLost = "other probe found the server first"
+
+// probe is one local address where the client looks for the server.
+type probe struct {
+	iface *net.Interface
+	addr  string
+	// bcast is the broadcast address where the server is looked for. If
+	// it is nil the broadcast of the subnet of addr is used.
+	bcast net.IP
+	// seed is the address of the server contacted directly. iface and
+	// addr aren't used.
+	seed string
+}
+
+// probes returns the local addresses and the seeds where the client looks
+// for the server.
+func (c *Client) probes() ([]probe, error) {
+	var probes []probe
+	if !c.SeedsOnly {
+		var err error
+		probes, err = c.locals()
+		if err != nil {
+			return nil, e.Forward(err)
+		}
+	} else if len(c.Seeds) == 0 {
+		return nil, e.New("no seeds")
+	}
+	for _, seed := range c.Seeds {
+		_, _, err := net.SplitHostPort(seed)
+		if err != nil {
+			seed = net.JoinHostPort(strings.Trim(seed, "[]"), c.Port)
+		}
+		probes = append(probes, probe{seed: seed})
+	}
+	return probes, nil
+}
+
+// locals returns the local addresses where the client looks for the server.
+func (c *Client) locals() ([]probe, error) {
+	if c.iface == nil && !c.AllInterfaces {
+		return nil, e.New(ErrNoInt)
+	}
+	ifaces := []*net.Interface{c.iface}
+	if c.AllInterfaces {
+		ints, err := c.candidates()
+		if err != nil {
+			return nil, e.Forward(err)
+		}
+		ifaces = ifaces[:0]
+		for _, in := range ints {
+			if in.Flags&net.FlagUp == 0 {
+				continue
+			}
+			if in.Flags&(net.FlagLoopback|net.FlagMulticast|net.FlagBroadcast) == 0 {
+				continue
+			}
+			ifaces = append(ifaces, in)
+		}
+	}
+	probes := make([]probe, 0, len(ifaces))
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, e.New(err)
+		}
+		var bcasts []net.IP
+		if c.AllSubnets && c.broadcasts(iface) {
+			bcasts, err = subnets(iface)
+			if err != nil {
+				return nil, e.Forward(err)
+			}
+		}
+		for _, addr := range addrs {
+			a := addr.String()
+			i := strings.Index(a, "/")
+			if i != -1 {
+				a = a[:i]
+			}
+			if !c.AddrAllowed(a) || !c.AddrInNetworks(a) {
+				continue
+			}
+			if c.multicasts(iface) && !c.isSource(a) {
+				continue
+			}
+			if len(bcasts) > 0 && utilNet.IsValidIpv4(a) {
+				for _, bcast := range bcasts {
+					probes = append(probes, probe{iface: iface, addr: a, bcast: bcast})
+				}
+				continue
+			}
+			probes = append(probes, probe{iface: iface, addr: a})
+		}
+	}
+	return probes, nil
+}
+
+// endpoint creates the connection in the local address of the probe and
+// returns it with the address where the server is looked for.
+func (c *Client) endpoint(p probe) (*net.UDPConn, *net.UDPAddr, error) {
+	if p.seed != "" {
+		return c.dial(p.seed)
+	}
+	iface, addr := p.iface, p.addr
+	ip, err := ipport(iface.Name, addr, "0")
+	if err != nil {
+		return nil, nil, e.Push(err, ErrCantFindInt)
+	}
+	client, err := net.ResolveUDPAddr("udp", ip)
+	if err != nil {
+		return nil, nil, e.Push(err, ErrCantFindInt)
+	}
+	conn, err := net.ListenUDP("udp", client)
+	if err != nil {
+		return nil, nil, e.Push(err, ErrCantFindInt)
+	}
+	var dst *net.UDPAddr
+	if iface.Flags&net.FlagLoopback == net.FlagLoopback {
+		ip, err := ipport(iface.Name, addr, c.Port)
+		if err != nil {
+			conn.Close()
+			return nil, nil, e.Push(err, ErrCantFindInt)
+		}
+		dst, err = net.ResolveUDPAddr("udp", ip)
+		if err != nil {
+			conn.Close()
+			return nil, nil, e.Push(err, ErrCantFindInt)
+		}
+	} else if c.multicasts(iface) {
+		dst, err = c.multicast(conn.LocalAddr())
+		if err != nil {
+			conn.Close()
+			return nil, nil, e.Push(err, ErrCantFindInt)
+		}
+		err = c.tune(conn, iface, dst.IP)
+		if err != nil {
+			conn.Close()
+			return nil, nil, e.Push(err, ErrCantFindInt)
+		}
+	} else if c.broadcasts(iface) {
+		dst, err = broadcast(iface, conn.LocalAddr(), c.Port)
+		if err != nil {
+			conn.Close()
+			return nil, nil, e.Push(err, ErrCantFindInt)
+		}
+		if p.bcast != nil {
+			dst.IP = p.bcast
+		}
+	} else {
+		conn.Close()
+		return nil, nil, e.Push(e.New("interface isn't suported: %v", iface.Flags), ErrCantFindInt)
+	}
+	return conn, dst, nil
+}
+
+// multicasts returns true if the client looks for the server in the group
+// of the interface.
+func (c *Client) multicasts(iface *net.Interface) bool {
+	return iface.Flags&net.FlagLoopback == 0 && !c.NotMulticast && iface.Flags&net.FlagMulticast == net.FlagMulticast
+}
+
+// dial creates the connection to contact the server directly in addr.
+func (c *Client) dial(addr string) (*net.UDPConn, *net.UDPAddr, error) {
+	dst, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, nil, e.New(err)
+	}
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, nil, e.New(err)
+	}
+	return conn, dst, nil
+}
+
+// broadcasts returns true if the client looks for the server in the
+// broadcast of the interface.
+func (c *Client) broadcasts(iface *net.Interface) bool {
+	return iface.Flags&net.FlagLoopback == 0 && !c.multicasts(iface) && iface.Flags&net.FlagBroadcast == net.FlagBroadcast
+}
+
+// probeResult is the outcome of one probe.
+type probeResult struct {
+	conn *net.UDPConn
+	dst  *net.UDPAddr
+	resp *Response
+	err  error
+}
+
+// getAddr probes all local addresses at the same time and keeps the
+// session made by the first one that the server answers.
+func (c *Client) getAddr() (*Response, error) {
+	probes, err := c.probes()
+	if err != nil {
+		return nil, e.Forward(err)
+	}
+	if len(probes) == 0 {
+		return nil, e.New("no addresses capable for listen udp")
+	}
+
+	var lck sync.Mutex
+	winner := -1
+	conns := make(map[int]*net.UDPConn)
+	found := make(chan struct{})
+	results := make(chan probeResult, len(probes))
+	for i, p := range probes {
+		go func(i int, p probe) {
+			select {
+			case <-time.After(time.Duration(i) * c.ProbeDelay):
+			case <-found:
+				results <- probeResult{err: e.New(ErrProbeLost)}
+				return
+			}
+			conn, dst, err := c.endpoint(p)
+			if err != nil {
+				results <- probeResult{err: err}
+				return
+			}
+			lck.Lock()
+			if winner != -1 {
+				lck.Unlock()
+				c.closeConn(conn)
+				results <- probeResult{err: e.New(ErrProbeLost)}
+				return
+			}
+			conns[i] = conn
+			lck.Unlock()
+			resp, err := c.handshake(conn, dst, func() bool {
+				lck.Lock()
+				defer lck.Unlock()
+				if winner == -1 {
+					winner = i
+					close(found)
+				}
+				return winner == i
+			})
+			if err != nil {
+				c.closeConn(conn)
+				results <- probeResult{err: err}
+				return
+			}
+			results <- probeResult{conn: conn, dst: dst, resp: resp}
+		}(i, p)
+	}
+
+	var won *probeResult
+	var errs []error
+	for range probes {
+		r := <-results
+		if r.err != nil {
+			errs = append(errs, r.err)
+			continue
+		}
+		won = &r
+		// Stop the probes that are still waiting for an answer.
+		lck.Lock()
+		for i, conn := range conns {
+			if i != winner {
+				conn.Close()
+			}
+		}
+		lck.Unlock()
+	}
+	if won != nil {
+		log.ProtoLevel().Tag("discover", "client").Printf("Server found in %v from %v.", won.dst, won.conn.LocalAddr())
+		c.start(won.conn, won.dst, won.resp)
+		return won.resp, nil
+	}
+	for _, err := range errs {
+		if e.Equal(err, ErrClientClosed) {
+			return nil, e.Forward(err)
+		}
+	}
+	for _, err := range errs {
+		if !e.Equal(err, ErrCantFindInt) && !e.Equal(err, ErrProbeLost) {
+			return nil, e.Forward(err)
+		}
+	}
+	return nil, e.New("no addresses capable for listen udp")
+}
@@ -0,0 +1,545 @@
+// Copyright 2015 Felipe A. Cavani. All rights reserved.
+// Use of this source code is governed by the Apache License 2.0
+// license that can be found in the LICENSE file.
+
+package discover
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fcavani/e"
+	"github.com/fcavani/log"
+)
+
+// ErrRelayLoop is returned when a message returns to a relay that already
+// forwarded it.
+const ErrRelayLoop = "message already forwarded by this relay"
+
+// ErrMaxHops is returned when a message was forwarded by too many relays.
+const ErrMaxHops = "message forwarded by too many relays"
+
+// Relay forwards the discovery messages of the clients in one network
+// segment to the servers in other segment, through other interface of the
+// host or through remote relays. The relay doesn't have the keys of the
+// clients and of the server, so the authentication is still between them.
+// Only the group messages are checked, if GroupKey is set, the others are
+// forwarded only if Unverified or Open allow them. The servers see the
+// relay as the client address.
+type Relay struct {
+	// In receives the messages of the clients. Only its interface, group,
+	// address version and port settings are used. If it is nil the relay
+	// only forwards the messages of other relays.
+	In *Server
+	// Out sends the messages to the servers. Only its interface, group,
+	// address version and port settings are used. It may be nil if Peers
+	// is set.
+	Out *Client
+	// Peers are the addresses of the remote relays where the messages are
+	// forwarded to.
+	Peers []string
+	// PeerPort is the port where the relay receives the messages from the
+	// remote relays. Default is 3457.
+	PeerPort string
+	// Key is the pre-shared key that authenticates the messages between
+	// relays. Without it the relay doesn't talk with other relays.
+	Key []byte
+	// MaxHops is the maximum number of relays that forward a message.
+	// Default is four.
+	MaxHops int
+	// Idle is the time without messages after which the path to a client
+	// is forgotten. Default is two minutes.
+	Idle time.Duration
+	// GroupKey is the pre-shared key of the group. If it is set the relay
+	// forwards only the group messages that it can open.
+	GroupKey []byte
+	// Unverified forwards the messages that the relay can't check, the
+	// RSA messages and, without GroupKey, the group messages.
+	Unverified bool
+	// Open forwards the plain and signed messages of the clients without
+	// keys, for servers in open mode.
+	Open bool
+	// BufSize is the buffer size and must be equal to the clients and
+	// servers. Default is 1024.
+	BufSize int
+	// MaxRoutes is the maximum number of clients with a path through the
+	// relay. The messages of new clients are dropped above it. Default is
+	// 128.
+	MaxRoutes int
+	// RateLimit is the number of messages per second forwarded from each
+	// client address. Default is ten.
+	RateLimit float64
+	// RateBurst is the number of messages forwarded in a burst above the
+	// RateLimit. Default is ten.
+	RateBurst int
+	id        uint64
+	out       probe
+	peers     []*net.UDPAddr
+	peer      *net.UDPConn
+	routes    map[string]*route
+	limits    *limiter
+	closed    chan struct{}
+	lck       sync.Mutex
+	wg        sync.WaitGroup
+}
+
+// route is the way back to one client.
+type route struct {
+	// conn sends the messages of the client to the servers in Out and
+	// receives their replies.
+	conn *net.UDPConn
+	dst  *net.UDPAddr
+	back func(pkt []byte) error
+	last time.Time
+}
+
+// tunnel is the message between relays.
+type tunnel struct {
+	// Origin is the relay that received the message from the client.
+	Origin uint64
+	// Client is the client address in the origin relay.
+	Client string
+	// Reply is true for the messages going back to the client.
+	Reply  bool
+	Packet []byte
+	Mac    []byte
+}
+
+func (t *tunnel) sum(key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	binary.Write(mac, binary.BigEndian, t.Origin)
+	mac.Write([]byte(t.Client + "\x00"))
+	if t.Reply {
+		mac.Write([]byte{1})
+	} else {
+		mac.Write([]byte{0})
+	}
+	mac.Write(t.Packet)
+	return mac.Sum(nil)
+}
+
+func routeKey(origin uint64, client string) string {
+	return strconv.FormatUint(origin, 16) + "/" + client
+}
+
+// Do starts the relay.
+func (r *Relay) Do() error {
+	if r.PeerPort == "" {
+		r.PeerPort = "3457"
+	}
+	if r.MaxHops <= 0 {
+		r.MaxHops = 4
+	}
+	if r.Idle <= 0 {
+		r.Idle = 2 * time.Minute
+	}
+	if r.BufSize <= 0 {
+		r.BufSize = 1024
+	}
+	if r.MaxRoutes <= 0 {
+		r.MaxRoutes = 128
+	}
+	if r.RateLimit <= 0 {
+		r.RateLimit = 10
+	}
+	if r.RateBurst <= 0 {
+		r.RateBurst = 10
+	}
+	if r.In == nil && len(r.Key) == 0 {
+		return e.New("relay has nothing to forward")
+	}
+	if r.Out == nil && len(r.Peers) == 0 {
+		return e.New("relay has nowhere to forward")
+	}
+	if len(r.Peers) > 0 && len(r.Key) == 0 {
+		return e.New("relay key is required to talk with other relays")
+	}
+	if len(r.GroupKey) == 0 && !r.Unverified && !r.Open {
+		return e.New("relay can't check any message, set GroupKey or Unverified")
+	}
+	err := binary.Read(rand.Reader, binary.BigEndian, &r.id)
+	if err != nil {
+		return e.New(err)
+	}
+	r.routes = make(map[string]*route)
+	r.limits = newLimiter(r.RateLimit, r.RateBurst)
+	r.closed = make(chan struct{})
+
+	for _, p := range r.Peers {
+		if _, _, err := net.SplitHostPort(p); err != nil {
+			p = net.JoinHostPort(strings.Trim(p, "[]"), r.PeerPort)
+		}
+		addr, err := net.ResolveUDPAddr("udp", p)
+		if err != nil {
+			return e.New(err)
+		}
+		r.peers = append(r.peers, addr)
+	}
+
+	if r.Out != nil {
+		if r.Out.Port == "" {
+			r.Out.Port = "3456"
+		}
+		r.Out.InitMCast()
+		if !r.Out.AllInterfaces {
+			err = r.Out.getInt()
+			if err != nil {
+				return e.Forward(err)
+			}
+		}
+		probes, err := r.Out.locals()
+		if err != nil {
+			return e.Forward(err)
+		}
+		if len(probes) == 0 {
+			return e.New(ErrNoInt)
+		}
+		r.out = probes[0]
+		conn, _, err := r.Out.endpoint(r.out)
+		if err != nil {
+			return e.Forward(err)
+		}
+		conn.Close()
+	}
+
+	if len(r.Key) > 0 {
+		addr, err := net.ResolveUDPAddr("udp", ":"+r.PeerPort)
+		if err != nil {
+			return e.New(err)
+		}
+		r.peer, err = net.ListenUDP("udp", addr)
+		if err != nil {
+			return e.New(err)
+		}
+		r.PeerPort = strconv.Itoa(r.peer.LocalAddr().(*net.UDPAddr).Port)
+		log.ProtoLevel().Tag("relay", "discover").Printf("Listen for relays in %v.", r.peer.LocalAddr())
+	}
+
+	if r.In != nil {
+		if r.In.Port == "" {
+			r.In.Port = "3456"
+		}
+		r.In.InitMCast()
+		lns, err := r.In.listen()
+		if err != nil {
+			if r.peer != nil {
+				r.peer.Close()
+			}
+			return e.Forward(err)
+		}
+		r.In.dups = newDups()
+		r.In.lckListeners.Lock()
+		r.In.listeners = lns
+		r.In.lckListeners.Unlock()
+		for _, conn := range conns(lns) {
+			r.wg.Add(1)
+			go r.serveIn(conn)
+		}
+	}
+	if r.peer != nil {
+		r.wg.Add(1)
+		go r.servePeers()
+	}
+	r.wg.Add(1)
+	go r.sweep()
+	return nil
+}
+
+// Close stops the relay.
+func (r *Relay) Close() error {
+	r.lck.Lock()
+	if r.closed == nil {
+		r.lck.Unlock()
+		return nil
+	}
+	select {
+	case <-r.closed:
+		r.lck.Unlock()
+		return nil
+	default:
+		close(r.closed)
+	}
+	r.lck.Unlock()
+	var err error
+	if r.In != nil {
+		err = r.In.closeListeners()
+	}
+	if r.peer != nil {
+		er := r.peer.Close()
+		if er != nil && err == nil {
+			err = e.New(er)
+		}
+	}
+	r.lck.Lock()
+	for key, rt := range r.routes {
+		if rt.conn != nil {
+			rt.conn.Close()
+		}
+		delete(r.routes, key)
+	}
+	r.lck.Unlock()
+	r.wg.Wait()
+	return err
+}
+
+// stamp checks the message and its hops and adds this relay to it.
+func (r *Relay) stamp(pkt []byte) ([]byte, error) {
+	var msg Msg
+	err := gob.NewDecoder(bytes.NewReader(pkt)).Decode(&msg)
+	if err != nil {
+		return nil, e.New(err)
+	}
+	switch msg.Mode {
+	case GroupMode:
+		if len(r.GroupKey) > 0 {
+			_, err = msg.GroupMessage(r.GroupKey)
+			if err != nil {
+				return nil, e.Push(err, "message isn't authenticated")
+			}
+		} else if !r.Unverified {
+			return nil, e.New("message can't be checked")
+		}
+	case RsaMode:
+		if !r.Unverified {
+			return nil, e.New("message can't be checked")
+		}
+	default:
+		if !r.Open {
+			return nil, e.New("message without authentication")
+		}
+	}
+	for _, id := range msg.Relays {
+		if id == r.id {
+			return nil, e.New(ErrRelayLoop)
+		}
+	}
+	if msg.Hops >= r.MaxHops {
+		return nil, e.New(ErrMaxHops)
+	}
+	msg.Hops++
+	msg.Relays = append(msg.Relays, r.id)
+	buf := bytes.NewBuffer([]byte{})
+	err = gob.NewEncoder(buf).Encode(&msg)
+	if err != nil {
+		return nil, e.New(err)
+	}
+	if buf.Len() > r.BufSize {
+		return nil, e.New("message is too big %v", buf.Len())
+	}
+	return buf.Bytes(), nil
+}
+
+// serveIn receives the messages of the clients.
+func (r *Relay) serveIn(conn *net.UDPConn) {
+	defer r.wg.Done()
+	for {
+		buf := make([]byte, r.BufSize)
+		n, addr, err := conn.ReadFromUDP(buf)
+		if e.Contains(err, "use of closed network connection") {
+			return
+		} else if err != nil {
+			log.Tag("discover", "relay").Printf("Relay - ReadFromUDP (%v) failed: %v", addr, e.Trace(e.New(err)))
+			continue
+		}
+		if r.In.dups.Dup(conn, addr, buf[:n]) {
+			continue
+		}
+		if !r.limits.Allow(addr.IP.String()) {
+			log.ProtoLevel().Tag("relay", "discover").Printf("Rate limit exceeded, message from %v dropped.", addr)
+			continue
+		}
+		pkt, err := r.stamp(buf[:n])
+		if err != nil {
+			log.ProtoLevel().Tag("relay", "discover").Printf("Message from %v dropped: %v", addr, err)
+			continue
+		}
+		ln := r.In.listener(conn, addr)
+		client := addr
+		rt, err := r.route(routeKey(r.id, addr.String()), func(pkt []byte) error {
+			_, err := ln.conn.WriteToUDP(pkt, client)
+			return err
+		})
+		if err != nil {
+			log.Tag("discover", "relay").Errorf("Can't forward the message from %v: %v", addr, err)
+			continue
+		}
+		r.forward(rt, r.id, addr.String(), pkt, nil)
+	}
+}
+
+// servePeers receives the messages of the remote relays.
+func (r *Relay) servePeers() {
+	defer r.wg.Done()
+	for {
+		buf := make([]byte, 2*r.BufSize)
+		n, addr, err := r.peer.ReadFromUDP(buf)
+		if e.Contains(err, "use of closed network connection") {
+			return
+		} else if err != nil {
+			log.Tag("discover", "relay").Printf("Relay - ReadFromUDP (%v) failed: %v", addr, e.Trace(e.New(err)))
+			continue
+		}
+		var t tunnel
+		err = gob.NewDecoder(bytes.NewReader(buf[:n])).Decode(&t)
+		if err != nil {
+			log.Tag("discover", "relay").Printf("Can't decode data from %v.", addr)
+			continue
+		}
+		if !hmac.Equal(t.Mac, t.sum(r.Key)) {
+			log.Tag("discover", "relay").Printf("Invalid relay message from %v.", addr)
+			continue
+		}
+		key := routeKey(t.Origin, t.Client)
+		if t.Reply {
+			r.lck.Lock()
+			rt, found := r.routes[key]
+			if found {
+				rt.last = time.Now()
+			}
+			r.lck.Unlock()
+			if !found {
+				continue
+			}
+			err = rt.back(t.Packet)
+			if err != nil {
+				log.Tag("discover", "relay").Errorf("Can't send the reply to %v: %v", t.Client, err)
+			}
+			continue
+		}
+		pkt, err := r.stamp(t.Packet)
+		if err != nil {
+			log.ProtoLevel().Tag("relay", "discover").Printf("Message from %v (%v) dropped: %v", t.Client, addr, err)
+			continue
+		}
+		from := addr
+		origin, client := t.Origin, t.Client
+		rt, err := r.route(key, func(pkt []byte) error {
+			return r.send(from, &tunnel{Origin: origin, Client: client, Reply: true, Packet: pkt})
+		})
+		if err != nil {
+			log.Tag("discover", "relay").Errorf("Can't forward the message from %v: %v", addr, err)
+			continue
+		}
+		r.forward(rt, t.Origin, t.Client, pkt, addr)
+	}
+}
+
+// route returns the way back to the client, creating it if needed.
+func (r *Relay) route(key string, back func(pkt []byte) error) (*route, error) {
+	r.lck.Lock()
+	defer r.lck.Unlock()
+	select {
+	case <-r.closed:
+		return nil, e.New("relay closed")
+	default:
+	}
+	rt, found := r.routes[key]
+	if found {
+		rt.last = time.Now()
+		return rt, nil
+	}
+	if len(r.routes) >= r.MaxRoutes {
+		return nil, e.New("too many routes")
+	}
+	rt = &route{back: back, last: time.Now()}
+	if r.Out != nil {
+		conn, dst, err := r.Out.endpoint(r.out)
+		if err != nil {
+			return nil, e.Forward(err)
+		}
+		rt.conn, rt.dst = conn, dst
+		r.wg.Add(1)
+		go r.serveOut(rt)
+	}
+	r.routes[key] = rt
+	return rt, nil
+}
+
+// serveOut sends the replies of the servers back to the client.
+func (r *Relay) serveOut(rt *route) {
+	defer r.wg.Done()
+	for {
+		buf := make([]byte, r.BufSize)
+		n, addr, err := rt.conn.ReadFromUDP(buf)
+		if e.Contains(err, "use of closed network connection") {
+			return
+		} else if err != nil {
+			log.Tag("discover", "relay").Printf("Relay - ReadFromUDP (%v) failed: %v", addr, e.Trace(e.New(err)))
+			continue
+		}
+		r.lck.Lock()
+		rt.last = time.Now()
+		r.lck.Unlock()
+		err = rt.back(buf[:n])
+		if err != nil {
+			log.Tag("discover", "relay").Errorf("Can't send the reply of %v: %v", addr, err)
+		}
+	}
+}
+
+// forward sends the message to the servers in Out and to the peers, but
+// the one where it came from.
+func (r *Relay) forward(rt *route, origin uint64, client string, pkt []byte, from *net.UDPAddr) {
+	if rt.conn != nil {
+		_, err := rt.conn.WriteToUDP(pkt, rt.dst)
+		if err != nil {
+			log.Tag("discover", "relay").Errorf("Can't forward the message of %v to %v: %v", client, rt.dst, err)
+		}
+	}
+	for _, peer := range r.peers {
+		if from != nil && peer.IP.Equal(from.IP) && peer.Port == from.Port {
+			continue
+		}
+		err := r.send(peer, &tunnel{Origin: origin, Client: client, Packet: pkt})
+		if err != nil {
+			log.Tag("discover", "relay").Errorf("Can't forward the message of %v to %v: %v", client, peer, err)
+		}
+	}
+}
+
+// send sends the message to other relay.
+func (r *Relay) send(addr *net.UDPAddr, t *tunnel) error {
+	t.Mac = t.sum(r.Key)
+	buf := bytes.NewBuffer([]byte{})
+	err := gob.NewEncoder(buf).Encode(t)
+	if err != nil {
+		return e.New(err)
+	}
+	_, err = r.peer.WriteToUDP(buf.Bytes(), addr)
+	if err != nil {
+		return e.New(err)
+	}
+	return nil
+}
+
+// sweep forgets the clients that are idle.
+func (r *Relay) sweep() {
+	defer r.wg.Done()
+	for {
+		select {
+		case <-r.closed:
+			return
+		case <-time.After(r.Idle / 2):
+		}
+		r.lck.Lock()
+		for key, rt := range r.routes {
+			if time.Since(rt.last) <= r.Idle {
+				continue
+			}
+			if rt.conn != nil {
+				rt.conn.Close()
+			}
+			delete(r.routes, key)
+		}
+		r.lck.Unlock()
+	}
+}
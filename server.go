@@ -6,10 +6,15 @@ package discover
 
 import (
 	"bytes"
+	gocontext "context"
 	"crypto/rsa"
 	"encoding/binary"
 	"encoding/gob"
+	"math"
+	"math/rand"
 	"net"
+	"runtime"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -25,6 +30,7 @@ const (
 	protoReq msgType = iota
 	protoConfirm
 	protoKeepAlive
+	protoLeave
 )
 
 func (m msgType) String() string {
@@ -35,11 +41,33 @@ func (m msgType) String() string {
 		return "keepalive"
 	case protoReq:
 		return "request"
+	case protoLeave:
+		return "leave"
 	default:
 		return "invalid"
 	}
 }
 
+// leaveMsg is the payload of the leave message. Seq binds it to one session
+// of the client.
+type leaveMsg struct {
+	Id  string
+	Seq uint16
+}
+
+// OpenMode controls how the server deals with clients without keys.
+type OpenMode uint8
+
+const (
+	// Closed answers only authenticated clients. This is the default.
+	Closed OpenMode = iota
+	// OpenSigned answers unauthenticated requests with responses signed
+	// with the server private key, so the client can still verify the server.
+	OpenSigned
+	// OpenPlain answers unauthenticated requests with plain responses.
+	OpenPlain
+)
+
 // Server wait for a client and send some data to it.
 type Server struct {
 	Intface
@@ -55,17 +83,112 @@ type Server struct {
 	PrivateKey *rsa.PrivateKey
 	// PubKeys hold all pubkeys that will be used.
 	PubKeys *PubKeys
-	// Duration time of one session
+	// GroupKey is a pre-shared key known by the server and all clients.
+	// If it is set the clients may use it instead of the RSA keys.
+	GroupKey []byte
+	// Open allows clients without keys to discover the server.
+	Open OpenMode
+	// Keepalive is the minimum keepalive interval accepted from the clients.
+	Keepalive time.Duration
+	// MaxKeepalive is the maximum keepalive interval accepted from the
+	// clients, longer ones are reduced to it. Default is two minutes, or
+	// Keepalive if it is longer.
+	MaxKeepalive time.Duration
+	// MissedKeepalives is the number of keepalives that a client can miss
+	// before its session is suspected to be dead.
+	MissedKeepalives int
+	// Duration was the lifetime of one session. It is ignored, the
+	// session lives while the client sends the keepalives.
+	//
+	// Deprecated: use Keepalive and MissedKeepalives.
 	Duration time.Duration
+	// Workers is the number of goroutines that handle the messages.
+	// Default is the number of CPUs.
+	Workers int
+	// QueueSize is the number of messages waiting in the queue of each worker.
+	QueueSize int
+	// Overflow is what to do when a queue is full.
+	Overflow Overflow
+	// ResponseDelay is the maximum random delay before answer a request.
+	// It spreads the responses when many clients ask at the same time.
+	// Zero or a negative delay answers at once.
+	ResponseDelay time.Duration
+	// Successor is the address of the server that replaces this one. It is
+	// sent to the clients when the server is closed.
+	Successor string
+	// PhiThreshold is the suspicion level, given by the phi accrual failure
+	// detector, that expires a session. Default is 8.
+	PhiThreshold float64
+	// RateLimit is the number of messages per second accepted from each
+	// source ip and from each client name. Zero disables the limit.
+	RateLimit float64
+	// RateBurst is the number of messages accepted in a burst above the
+	// RateLimit. Default is ten.
+	RateBurst int
+	// BanAfter is the number of messages that fail the authentication
+	// before the source ip is banned. Zero disables the ban. It turns on
+	// Cookies, so only the sources that prove their address are banned,
+	// and a spoofed address can't ban a legitimate client.
+	BanAfter int
+	// BanTime is for how long the source ip is banned. Default is ten minutes.
+	BanTime time.Duration
+	// Cookies makes the server answer the messages without a valid cookie
+	// with a small cookie challenge, before any expensive work. The
+	// client must echo the cookie, proving that it owns its address.
+	Cookies bool
+	// Interfaces are the names of the interfaces where the server listens,
+	// with one socket for each one. If it is empty the server listens only
+	// in Interface.
+	Interfaces []string
+	// AllInterfaces makes the server listen in all interfaces that are up
+	// and have an address.
+	AllInterfaces bool
+	// DualStack makes the server join the IPv4 and the IPv6 groups in the
+	// interfaces that have both, so the clients of both versions find the
+	// same server. The sessions are the same for both versions. AddrVer
+	// must be Any.
+	DualStack bool
+	// Monitor makes the server watch the interfaces and listen again when
+	// they or their addresses change.
+	Monitor bool
+	// MonitorInterval is the interval between the checks of the network.
+	// Where the kernel notifies the changes they are seen before. Default
+	// is five seconds.
+	MonitorInterval time.Duration
+	// OnNetEvent is called for each change in the interfaces of the server.
+	OnNetEvent func(ev NetEvent)
 	// Name is the server name. Used to identify the key
-	Name   string
-	conn   *net.UDPConn
-	seq    []*net.UDPAddr
-	lckSeq sync.Mutex
-	ctxs   *contexts
+	Name string
+	// OnRequest is called when a client requests a session.
+	OnRequest func(s *Session)
+	// OnConfirm is called when a client confirms its session.
+	OnConfirm func(s *Session)
+	// OnKeepAlive is called for every keepalive received from a client.
+	OnKeepAlive func(s *Session)
+	// OnExpire is called when a session expires.
+	OnExpire func(s *Session)
+	// OnLeave is called when a session is removed before it expires,
+	// like when the client leaves, it is kicked or the server is closed.
+	OnLeave      func(s *Session)
+	listeners    []*listener
+	lckListeners sync.RWMutex
+	watcher      *watcher
+	closed       bool
+	lckBind      sync.Mutex
+	dups         *dups
+	seq          []*net.UDPAddr
+	lckSeq       sync.Mutex
+	inflight     map[string]*pending
+	lckInflight  sync.Mutex
+	pool         *pool
+	limits       *limiter
+	bans         *banList
+	cookies      *cookies
+	ctxs         *contexts
 }
 
-func (a *Server) sendErr(addr *net.UDPAddr, er error) {
+func (a *Server) sendErr(p *peer, er error) {
+	addr := p.Addr
 	respBuf := bytes.NewBuffer([]byte{})
 	enc := gob.NewEncoder(respBuf)
 	msg := &Msg{
@@ -80,7 +203,7 @@ func (a *Server) sendErr(addr *net.UDPAddr, er error) {
 		log.Tag("discover", "server").Error("Error encoding erro response: error response is too long", respBuf.Len())
 		return
 	}
-	_, _, err = a.conn.WriteMsgUDP(respBuf.Bytes(), nil, addr)
+	_, _, err = p.ln.conn.WriteMsgUDP(respBuf.Bytes(), nil, addr)
 	if err != nil {
 		log.Tag("discover", "server").Error("Error sending erro response:", err)
 	}
@@ -95,95 +218,271 @@ func (a *Server) Do() error {
 	if a.BufSize <= 0 {
 		a.BufSize = 1024
 	}
-	if a.Duration == 0 {
-		a.Duration = 24 * time.Hour
+	if a.Keepalive <= 0 {
+		a.Keepalive = 10 * time.Second
+	}
+	if a.MaxKeepalive <= 0 {
+		a.MaxKeepalive = 2 * time.Minute
+	}
+	if a.MaxKeepalive < a.Keepalive {
+		a.MaxKeepalive = a.Keepalive
+	}
+	if a.MissedKeepalives <= 0 {
+		a.MissedKeepalives = 3
+	}
+	if a.PhiThreshold <= 0 {
+		a.PhiThreshold = 8
 	}
 	if a.Name == "" {
 		a.Name = "master"
 	}
+	if a.DualStack && a.AddrVer != Any {
+		return e.New("dual stack needs AddrVer Any")
+	}
+	if a.Open == OpenSigned && a.PrivateKey == nil {
+		return e.New("open signed mode needs the server private key")
+	}
+	if a.Workers <= 0 {
+		a.Workers = runtime.NumCPU()
+	}
+	if a.QueueSize <= 0 {
+		a.QueueSize = 64
+	}
+	if a.MonitorInterval <= 0 {
+		a.MonitorInterval = 5 * time.Second
+	}
+	if a.RateBurst <= 0 {
+		a.RateBurst = 10
+	}
+	if a.BanTime <= 0 {
+		a.BanTime = 10 * time.Minute
+	}
+	if a.RateLimit > 0 {
+		a.limits = newLimiter(a.RateLimit, a.RateBurst)
+	}
+	if a.BanAfter > 0 {
+		a.bans = newBanList(a.BanAfter, a.BanTime)
+		a.Cookies = true
+	}
+	if a.Cookies {
+		c, err := newCookies()
+		if err != nil {
+			return e.Forward(err)
+		}
+		a.cookies = c
+	}
 	a.seq = make([]*net.UDPAddr, 0)
-	a.ctxs = newContexts(a.Duration, 300*time.Second)
+	a.inflight = make(map[string]*pending)
+	a.ctxs = newContexts(a.Keepalive, a.PhiThreshold, func(ctx *context) {
+		log.ProtoLevel().Tag("server", "discover").Printf("Session %v from %v expired.", ctx.Id, ctx.Addr)
+		a.event(a.OnExpire, ctx)
+	})
 	a.InitMCast()
-	err := a.getInt()
+	var states map[string]*netState
+	if a.Monitor {
+		var err error
+		states, err = snapshot()
+		if err != nil {
+			return e.Forward(err)
+		}
+	}
+	lns, err := a.listen()
 	if err != nil {
 		return e.Forward(err)
 	}
-	a.conn, err = a.bind()
+	a.dups = newDups()
+	a.pool = newPool(a.Workers, a.QueueSize, a.Overflow)
+	a.serveAll(lns)
+	if a.Monitor {
+		a.watcher = newWatcher(a.MonitorInterval)
+		go a.monitor(a.watcher, states)
+	}
+	return nil
+}
+
+// serve reads the messages that arrive in conn.
+func (a *Server) serve(conn *net.UDPConn) {
+	for {
+		buf := make([]byte, a.BufSize)
+		n, addr, err := conn.ReadFromUDP(buf)
+		if e.Contains(err, "use of closed network connection") {
+			return
+		} else if err != nil {
+			log.Tag("discover", "server").Printf("Server - ReadFromUDP (%v) failed: %v", addr, e.Trace(e.New(err)))
+			continue
+		}
+
+		if a.dups.Dup(conn, addr, buf[:n]) {
+			continue
+		}
+		ln := a.listener(conn, addr)
+		if ln == nil {
+			// The listeners were closed.
+			continue
+		}
+
+		// Drop the abusive sources before any expensive work.
+		ip := addr.IP.String()
+		if a.bans != nil && a.bans.Banned(ip) {
+			continue
+		}
+		if a.limits != nil && !a.limits.Allow("ip:"+ip) {
+			log.ProtoLevel().Tag("server", "discover").Printf("Rate limit exceeded by %v.", addr)
+			continue
+		}
+
+		dec := gob.NewDecoder(bytes.NewReader(buf[:n]))
+		var msg Msg
+		err = dec.Decode(&msg)
+		if err != nil {
+			log.Tag("discover", "server").Printf("Can't decode data from %v.", addr)
+			continue
+		}
+
+		if a.limits != nil && msg.From != "" && !a.limits.Allow("name:"+msg.From) {
+			log.ProtoLevel().Tag("server", "discover").Printf("Rate limit exceeded by %v (%v).", msg.From, addr)
+			continue
+		}
+
+		if a.cookies != nil && !a.cookies.Valid(addr, msg.Cookie) {
+			log.ProtoLevel().Tag("server", "discover").Printf("Send cookie to %v.", addr)
+			a.sendCookie(ln, addr, msg.From)
+			continue
+		}
+
+		// The messages from one address are handled in order by the same worker.
+		a.pool.Submit(addr.String(), func() {
+			a.handle(ln, addr, &msg)
+		}, func() {
+			log.Tag("discover", "server").Printf("Queue is full, message from %v dropped.", addr)
+		})
+	}
+}
+
+// handle authenticates the message and runs the protocol step.
+func (a *Server) handle(ln *listener, addr *net.UDPAddr, msg *Msg) {
+	p, buf, err := a.open(ln, addr, msg)
 	if err != nil {
-		return e.Forward(err)
+		log.Tag("discover", "server").Printf("Invalid message from %v: %v.", addr, err)
+		if a.bans != nil && a.bans.Fail(addr.IP.String()) {
+			log.Tag("discover", "server").Printf("Source %v banned for %v.", addr.IP, a.BanTime)
+		}
+		return
 	}
-	go func() {
-		for {
-			buf := make([]byte, a.BufSize)
-			n, addr, err := a.conn.ReadFromUDP(buf)
-			if e.Contains(err, "use of closed network connection") {
-				return
-			} else if err != nil {
-				log.Tag("discover", "server").Printf("Server - ReadFromUDP (%v) failed: %v", addr, e.Trace(e.New(err)))
-				continue
-			}
 
-			dec := gob.NewDecoder(bytes.NewReader(buf[:n]))
-			var msg Msg
-			err = dec.Decode(&msg)
-			if err != nil {
-				log.Tag("discover", "server").Printf("Can't decode data from %v.", addr)
-				continue
-			}
+	if len(buf) < binary.MaxVarintLen16 {
+		log.Tag("discover", "server").Printf("Read insulficient data from %v.", addr)
+		return
+	}
+	typ, b := binary.Uvarint(buf[:binary.MaxVarintLen16])
+	if b <= 0 {
+		log.Tag("discover", "server").Print("Invalid package type from %v.", addr)
+		return
+	}
+	t := msgType(typ)
+	log.ProtoLevel().Tag("server", "discover").Printf("Received %v request from %v.", t, addr)
+	switch t {
+	case protoConfirm:
+		a.confirm(p, buf[binary.MaxVarintLen16:])
+	case protoReq:
+		a.request(p, buf[binary.MaxVarintLen16:])
+	case protoKeepAlive:
+		a.keepalive(p, buf[binary.MaxVarintLen16:])
+	case protoLeave:
+		a.leave(p, buf[binary.MaxVarintLen16:])
+	default:
+		log.Tag("discover", "server").Errorf("Protocol error. (%v)", typ)
+	}
+}
 
-			pubkey, err := a.PubKeys.Get(msg.From)
-			if err != nil {
-				log.Tag("discover", "server").Printf("Invalid %v sender from %v.", msg.From, addr)
-				continue
-			}
+// peer is the client that sent a message.
+type peer struct {
+	Addr *net.UDPAddr
+	ln   *listener
+	Name string
+	Key  *rsa.PublicKey
+	Mode MsgMode
+}
 
-			buf, err = msg.Message(pubkey, a.PrivateKey)
-			if err != nil {
-				log.Tag("discover", "server").Printf("Invalid message from %v: %v.", addr, err)
-				continue
-			}
+// open authenticates and decrypts a message from a client.
+func (a *Server) open(ln *listener, addr *net.UDPAddr, msg *Msg) (*peer, []byte, error) {
+	p := &peer{
+		Addr: addr,
+		ln:   ln,
+		Name: msg.From,
+		Mode: msg.Mode,
+	}
+	switch msg.Mode {
+	case RsaMode:
+		if a.PubKeys == nil || a.PrivateKey == nil {
+			return nil, nil, e.New("rsa mode isn't configured")
+		}
+		pubkey, err := a.PubKeys.Get(msg.From)
+		if err != nil {
+			return nil, nil, e.Push(err, e.New("invalid sender %v", msg.From))
+		}
+		buf, err := msg.Message(pubkey, a.PrivateKey)
+		if err != nil {
+			return nil, nil, e.Forward(err)
+		}
+		p.Key = pubkey
+		return p, buf, nil
+	case GroupMode:
+		if len(a.GroupKey) == 0 {
+			return nil, nil, e.New("group mode isn't configured")
+		}
+		buf, err := msg.GroupMessage(a.GroupKey)
+		if err != nil {
+			return nil, nil, e.Forward(err)
+		}
+		return p, buf, nil
+	case PlainMode:
+		if a.Open == Closed {
+			return nil, nil, e.New("unauthenticated requests aren't allowed")
+		}
+		buf, err := msg.PlainMessage()
+		if err != nil {
+			return nil, nil, e.Forward(err)
+		}
+		return p, buf, nil
+	default:
+		return nil, nil, e.New("invalid message mode %v", msg.Mode)
+	}
+}
 
-			if len(buf) < binary.MaxVarintLen16 {
-				log.Tag("discover", "server").Printf("Read insulficient data from %v.", addr)
-				continue
-			}
-			typ, b := binary.Uvarint(buf[:binary.MaxVarintLen16])
-			if b <= 0 {
-				log.Tag("discover", "server").Print("Invalid package type from %v.", addr)
-				continue
-			}
-			t := msgType(typ)
-			log.ProtoLevel().Tag("server", "discover").Printf("Received %v request from %v.", t, addr)
-			switch t {
-			case protoConfirm:
-				go a.confirm(addr, msg.From, pubkey, buf[binary.MaxVarintLen16:])
-			case protoReq:
-				go a.request(addr, msg.From, pubkey, buf[binary.MaxVarintLen16:])
-			case protoKeepAlive:
-				go a.keepalive(addr, msg.From, pubkey, buf[binary.MaxVarintLen16:])
-			default:
-				log.Tag("discover", "server").Errorf("Protocol error. (%v)", typ)
-			}
+// seal creates the message to the peer using the same mode that the peer used.
+func (a *Server) seal(p *peer, data []byte) (*Msg, error) {
+	switch p.Mode {
+	case RsaMode:
+		return NewMsg(a.Name, p.Name, a.PrivateKey, p.Key, data)
+	case GroupMode:
+		return NewGroupMsg(a.Name, p.Name, a.GroupKey, data)
+	case PlainMode:
+		if a.Open == OpenSigned {
+			return NewSignedMsg(a.Name, p.Name, a.PrivateKey, data)
 		}
-	}()
-	return nil
+		return NewPlainMsg(a.Name, p.Name, data), nil
+	default:
+		return nil, e.New("invalid message mode %v", p.Mode)
+	}
 }
 
-func (a *Server) sendResp(resp *Response, to string, tokey *rsa.PublicKey, addr *net.UDPAddr) {
-	log.ProtoLevel().Tag("server", "discover").Printf("Send response from %v to %v", a.conn.LocalAddr(), addr)
+func (a *Server) sendResp(resp *Response, p *peer) {
+	addr := p.Addr
+	log.ProtoLevel().Tag("server", "discover").Printf("Send response from %v (%v) to %v", p.ln.conn.LocalAddr(), p.ln.Name(), addr)
 	respBuf := bytes.NewBuffer([]byte{})
 	enc := gob.NewEncoder(respBuf)
 	err := enc.Encode(resp)
 	if err != nil {
 		log.Tag("discover", "server").Printf("Server - Protocol fail for %v with error: %v", addr, e.Trace(e.New(err)))
-		a.sendErr(addr, e.Push(err, e.New("error enconding response")))
+		a.sendErr(p, e.Push(err, e.New("error enconding response")))
 		return
 	}
 
-	msg, err := NewMsg(a.Name, to, a.PrivateKey, tokey, respBuf.Bytes())
+	msg, err := a.seal(p, respBuf.Bytes())
 	if err != nil {
 		log.Tag("discover", "server").Printf("Server - Protocol fail for %v with error: %v", addr, e.Trace(e.New(err)))
-		a.sendErr(addr, e.Push(err, e.New("error creating new response message")))
+		a.sendErr(p, e.Push(err, e.New("error creating new response message")))
 		return
 	}
 
@@ -192,16 +491,16 @@ func (a *Server) sendResp(resp *Response, to string, tokey *rsa.PublicKey, addr
 	err = enc.Encode(msg)
 	if err != nil {
 		log.Tag("discover", "server").Printf("Server - Protocol fail for %v with error: %v", addr, e.Trace(e.New(err)))
-		a.sendErr(addr, e.Push(err, e.New("error enconding response")))
+		a.sendErr(p, e.Push(err, e.New("error enconding response")))
 		return
 	}
 
 	if respBuf.Len() > a.BufSize {
 		log.Tag("discover", "server").Printf("Server - Protocol fail for %v message is too big (%v).", addr, respBuf.Len())
-		a.sendErr(addr, e.Push(err, e.New("response is too long %v", respBuf.Len())))
+		a.sendErr(p, e.Push(err, e.New("response is too long %v", respBuf.Len())))
 		return
 	}
-	n, oob, err := a.conn.WriteMsgUDP(respBuf.Bytes(), nil, addr)
+	n, oob, err := p.ln.conn.WriteMsgUDP(respBuf.Bytes(), nil, addr)
 	if e.Contains(err, "use of closed network connection") {
 		return
 	} else if err != nil {
@@ -218,20 +517,107 @@ func (a *Server) sendResp(resp *Response, to string, tokey *rsa.PublicKey, addr
 	}
 }
 
-func (a *Server) request(addr *net.UDPAddr, to string, tokey *rsa.PublicKey, buf []byte) {
+// pending is a request being answered and the peers waiting for it.
+type pending struct {
+	req   *Request
+	peers []*peer
+}
+
+// same returns true if the request of p can share the answer of the
+// pending request, that is sealed to each peer.
+func (pend *pending) same(p *peer, req *Request) bool {
+	first := pend.peers[0]
+	return p.Name == first.Name && p.Mode == first.Mode &&
+		req.Keepalive == pend.req.Keepalive && bytes.Equal(req.Data, pend.req.Data)
+}
+
+func (a *Server) request(p *peer, buf []byte) {
+	addr := p.Addr
 	dec := gob.NewDecoder(bytes.NewReader(buf))
 	var req Request
 	err := dec.Decode(&req)
 	if err != nil {
 		log.Tag("discover", "server").Printf("Server - Protocol fail for %v with error: %v", addr, e.Trace(e.New(err)))
-		a.sendErr(addr, e.Push(err, e.New("error decoding request")))
+		a.sendErr(p, e.Push(err, e.New("error decoding request")))
 		return
 	}
-	resp, err := a.Protocol(addr, &req)
+
+	// Requests with the same id are answered once, the duplicated request
+	// from the same address is dropped and the same request from other
+	// address aggregated. Other requests with the id are answered alone.
+	a.lckInflight.Lock()
+	pend, found := a.inflight[req.Id]
+	switch {
+	case found && pend.same(p, &req):
+		for _, q := range pend.peers {
+			if q.Addr.String() == addr.String() {
+				a.lckInflight.Unlock()
+				log.ProtoLevel().Tag("server", "discover").Printf("Duplicated request %v from %v dropped.", req.Id, addr)
+				return
+			}
+		}
+		pend.peers = append(pend.peers, p)
+		a.lckInflight.Unlock()
+		log.ProtoLevel().Tag("server", "discover").Printf("Request %v from %v aggregated.", req.Id, addr)
+		return
+	case found:
+		a.lckInflight.Unlock()
+		pend = &pending{req: &req, peers: []*peer{p}}
+	default:
+		pend = &pending{req: &req, peers: []*peer{p}}
+		a.inflight[req.Id] = pend
+		a.lckInflight.Unlock()
+	}
+
+	if a.ResponseDelay <= 0 {
+		a.respond(p, &req, pend)
+		return
+	}
+	// Don't hold the worker while waiting.
+	delay := time.Duration(rand.Int63n(int64(a.ResponseDelay)))
+	time.AfterFunc(delay, func() {
+		a.pool.Submit(addr.String(), func() {
+			a.respond(p, &req, pend)
+		}, func() {
+			log.Tag("discover", "server").Printf("Queue is full, request %v from %v dropped.", req.Id, addr)
+			a.done(req.Id, pend)
+		})
+	})
+}
+
+// respond answers the request to all peers waiting for it.
+func (a *Server) respond(p *peer, req *Request, pend *pending) {
+	resp, err := a.answer(p, req)
+	a.done(req.Id, pend)
+
+	for _, q := range pend.peers {
+		if err != nil {
+			a.sendErr(q, err)
+			continue
+		}
+		// Each peer sees its own address.
+		r := *resp
+		r.Ip = q.Addr.String()
+		a.sendResp(&r, q)
+	}
+}
+
+// done removes the pending request, if it is the one in flight for the id.
+func (a *Server) done(id string, pend *pending) {
+	a.lckInflight.Lock()
+	if a.inflight[id] == pend {
+		delete(a.inflight, id)
+	}
+	a.lckInflight.Unlock()
+}
+
+// answer calls the Protocol function and registers the session of the client.
+func (a *Server) answer(p *peer, req *Request) (*Response, error) {
+	addr := p.Addr
+	resp, err := a.Protocol(addr, req)
 	if err != nil {
 		log.Tag("discover", "server").Printf("Server - Protocol fail for %v with error: %v", addr, e.Trace(e.New(err)))
-		a.sendErr(addr, e.Push(err, e.New("protocol error")))
-		return
+		return nil, e.Push(err, e.New("protocol error"))
 	}
 
 	ctx, err := a.ctxs.Get(req.Id)
@@ -241,81 +627,245 @@ func (a *Server) request(addr *net.UDPAddr, to string, tokey *rsa.PublicKey, buf
 		a.lckSeq.Lock()
 		resp.Seq = uint16(len(a.seq))
 		a.lckSeq.Unlock()
-		err = a.ctxs.Register(&context{
-			Id:   req.Id,
-			Seq:  resp.Seq,
-			Addr: addr,
-		})
+		keepalive := a.Keepalive
+		if req.Keepalive > keepalive {
+			keepalive = req.Keepalive
+		}
+		if keepalive > a.MaxKeepalive {
+			keepalive = a.MaxKeepalive
+		}
+		timeout := keepalive * time.Duration(a.MissedKeepalives)
+		if timeout/time.Duration(a.MissedKeepalives) != keepalive {
+			timeout = math.MaxInt64
+		}
+		ctx = &context{
+			Id:        req.Id,
+			Seq:       resp.Seq,
+			Addr:      addr,
+			Name:      p.Name,
+			Keepalive: keepalive,
+			Timeout:   timeout,
+			Mode:      p.Mode,
+			Interface: p.ln.Name(),
+		}
+		err = a.ctxs.Register(ctx)
 		if err != nil {
 			log.Tag("discover", "server").Printf("Server - Protocol fail for %v with error: %v", addr, e.Trace(e.New(err)))
-			a.sendErr(addr, e.Push(err, e.New("protocol error")))
-			return
+			return nil, e.Push(err, e.New("protocol error"))
 		}
 	} else {
 		resp.Id = ctx.Id
 		resp.Ip = ctx.Addr.String()
 		resp.Seq = ctx.Seq
 	}
-	a.sendResp(resp, to, tokey, addr)
+	resp.Keepalive = ctx.Keepalive
+	resp.Timeout = ctx.Timeout
+	a.event(a.OnRequest, ctx)
+	return resp, nil
 }
 
-func (a *Server) confirm(addr *net.UDPAddr, to string, tokey *rsa.PublicKey, buf []byte) {
+func (a *Server) confirm(p *peer, buf []byte) {
+	addr := p.Addr
 	dec := gob.NewDecoder(bytes.NewReader(buf))
 	var id string
 	err := dec.Decode(&id)
 	if err != nil {
 		log.Tag("discover", "server").Printf("Server - Protocol fail for %v with error: %v", addr, e.Trace(e.New(err)))
-		a.sendErr(addr, e.Push(err, e.New("error decoding id")))
+		a.sendErr(p, e.Push(err, e.New("error decoding id")))
 		return
 	}
-	ctx, err := a.ctxs.Get(id)
+	ctx, err := a.ctxs.Move(id, addr, p.ln.Name())
 	if err != nil {
 		log.Tag("discover", "server").Printf("Server - Protocol fail for %v with error: %v", addr, e.Trace(e.New(err)))
-		a.sendErr(addr, e.Push(err, e.New("id is invalid")))
+		a.sendErr(p, e.Push(err, e.New("id is invalid")))
 		return
 	}
 	a.lckSeq.Lock()
 	a.seq = append(a.seq, ctx.Addr)
 	a.lckSeq.Unlock()
-	a.sendResp(&Response{
-		Id:  ctx.Id,
-		Ip:  ctx.Addr.String(),
-		Seq: ctx.Seq,
-	}, to, tokey, addr)
+	a.event(a.OnConfirm, ctx)
+	a.sendResp(ctx.response(), p)
 }
 
-func (a *Server) keepalive(addr *net.UDPAddr, to string, tokey *rsa.PublicKey, buf []byte) {
+func (a *Server) keepalive(p *peer, buf []byte) {
+	addr := p.Addr
 	dec := gob.NewDecoder(bytes.NewReader(buf))
 	var id string
 	err := dec.Decode(&id)
 	if err != nil {
 		log.Tag("discover", "server").Printf("Server - Protocol fail for %v with error: %v", addr, e.Trace(e.New(err)))
-		a.sendErr(addr, e.Push(err, e.New("error decoding id")))
+		a.sendErr(p, e.Push(err, e.New("error decoding id")))
 		return
 	}
-	ctx, err := a.ctxs.Get(id)
+	ctx, err := a.ctxs.KeepAlive(id)
 	if err != nil {
 		log.Tag("discover", "server").Printf("Server - Protocol fail for %v with error: %v", addr, e.Trace(e.New(err)))
-		a.sendErr(addr, e.Push(err, e.New("id is invalid")))
+		a.sendErr(p, e.Push(err, e.New("id is invalid")))
 		return
 	}
-	a.sendResp(&Response{
-		Id:  ctx.Id,
-		Ip:  ctx.Addr.String(),
-		Seq: ctx.Seq,
-	}, to, tokey, addr)
+	a.event(a.OnKeepAlive, ctx)
+	a.sendResp(ctx.response(), p)
+}
+
+func (a *Server) leave(p *peer, buf []byte) {
+	addr := p.Addr
+	dec := gob.NewDecoder(bytes.NewReader(buf))
+	var lm leaveMsg
+	err := dec.Decode(&lm)
+	if err != nil {
+		log.Tag("discover", "server").Printf("Server - Protocol fail for %v with error: %v", addr, e.Trace(e.New(err)))
+		a.sendErr(p, e.Push(err, e.New("error decoding id")))
+		return
+	}
+	ctx, err := a.ctxs.Peek(lm.Id)
+	if err != nil {
+		log.Tag("discover", "server").Printf("Server - Protocol fail for %v with error: %v", addr, e.Trace(e.New(err)))
+		a.sendErr(p, e.Push(err, e.New("id is invalid")))
+		return
+	}
+	if ctx.Name != p.Name {
+		log.Tag("discover", "server").Printf("Server - Protocol fail for %v: %v can't remove the session of %v", addr, p.Name, ctx.Name)
+		a.sendErr(p, e.New("id is invalid"))
+		return
+	}
+	// A leave of an old session must not remove a new session with the
+	// same id.
+	if ctx.Seq != lm.Seq {
+		log.Tag("discover", "server").Printf("Server - Protocol fail for %v: leave of other session of %v", addr, ctx.Id)
+		a.sendErr(p, e.New("id is invalid"))
+		return
+	}
+	// The name isn't authenticated in the open modes.
+	if p.Mode != RsaMode && p.Mode != GroupMode && ctx.Addr.String() != addr.String() {
+		log.Tag("discover", "server").Printf("Server - Protocol fail for %v: unauthenticated leave of %v from other address", addr, ctx.Id)
+		a.sendErr(p, e.New("id is invalid"))
+		return
+	}
+	ctx, err = a.ctxs.Del(lm.Id)
+	if err != nil {
+		log.Tag("discover", "server").Printf("Server - Protocol fail for %v with error: %v", addr, e.Trace(e.New(err)))
+		a.sendErr(p, e.Push(err, e.New("id is invalid")))
+		return
+	}
+	log.ProtoLevel().Tag("server", "discover").Printf("Session %v from %v left.", ctx.Id, ctx.Addr)
+	a.event(a.OnLeave, ctx)
+	a.sendResp(ctx.response(), p)
 }
 
-// Close terminates the server.
+// Close notifies all clients that the server is closing and terminates the server.
 func (a *Server) Close() error {
-	err := a.conn.Close()
+	a.lckBind.Lock()
+	if a.closed {
+		a.lckBind.Unlock()
+		return nil
+	}
+	a.closed = true
+	a.lckBind.Unlock()
+	for _, ctx := range a.ctxs.All() {
+		a.notifyClosing(ctx)
+	}
+	if a.watcher != nil {
+		a.watcher.Close()
+	}
+	a.lckBind.Lock()
+	err := a.closeListeners()
+	a.lckBind.Unlock()
+	a.pool.Close()
+	a.ctxs.Close()
+	for _, ctx := range a.ctxs.Clear() {
+		a.event(a.OnLeave, ctx)
+	}
 	if err != nil {
 		return e.Forward(err)
 	}
-	a.ctxs.Close()
 	return nil
 }
 
+// notifyClosing sends to the client of the session the notice that the
+// server is closing.
+func (a *Server) notifyClosing(ctx *context) {
+	ln := a.route(ctx.Addr)
+	if ln == nil {
+		log.Tag("discover", "server").Printf("Can't notify %v: no socket", ctx.Addr)
+		return
+	}
+	p := &peer{
+		Addr: ctx.Addr,
+		ln:   ln,
+		Name: ctx.Name,
+		Mode: ctx.Mode,
+	}
+	if ctx.Mode == RsaMode {
+		key, err := a.PubKeys.Get(ctx.Name)
+		if err != nil {
+			log.Tag("discover", "server").Printf("Can't notify %v: %v", ctx.Addr, err)
+			return
+		}
+		p.Key = key
+	}
+	// Only the essential, the notice must fit in one message.
+	a.sendResp(&Response{
+		Id:        ctx.Id,
+		Seq:       ctx.Seq,
+		Closing:   true,
+		Successor: a.Successor,
+	}, p)
+}
+
+// Sessions returns a snapshot of all active sessions ordered by Seq.
+func (a *Server) Sessions() []*Session {
+	if a.ctxs == nil {
+		return []*Session{}
+	}
+	ctxs := a.ctxs.All()
+	sessions := make([]*Session, 0, len(ctxs))
+	for _, ctx := range ctxs {
+		sessions = append(sessions, ctx.session())
+	}
+	sort.Sort(sessionsBySeq(sessions))
+	return sessions
+}
+
+// Session returns the snapshot of the session with this id.
+func (a *Server) Session(id string) (*Session, error) {
+	if a.ctxs == nil {
+		return nil, e.New(ErrCtxNotFound)
+	}
+	ctx, err := a.ctxs.Peek(id)
+	if err != nil {
+		return nil, e.Forward(err)
+	}
+	return ctx.session(), nil
+}
+
+// Kick removes the session with this id. OnLeave is called for it.
+func (a *Server) Kick(id string) error {
+	if a.ctxs == nil {
+		return e.New(ErrCtxNotFound)
+	}
+	ctx, err := a.ctxs.Del(id)
+	if err != nil {
+		return e.Forward(err)
+	}
+	log.ProtoLevel().Tag("server", "discover").Printf("Session %v from %v kicked.", ctx.Id, ctx.Addr)
+	a.event(a.OnLeave, ctx)
+	return nil
+}
+
+type sessionsBySeq []*Session
+
+func (s sessionsBySeq) Len() int           { return len(s) }
+func (s sessionsBySeq) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s sessionsBySeq) Less(i, j int) bool { return s[i].Seq < s[j].Seq }
+
+// event calls the callback fn, if it exists, with the session of ctx.
+func (a *Server) event(fn func(s *Session), ctx *context) {
+	if fn == nil {
+		return
+	}
+	fn(ctx.session())
+}
+
 func (s *Server) ipver(addr net.Addr) {
 	a := addr.String()
 	if utilNet.IsValidIpv6(a) {
@@ -325,27 +875,32 @@ func (s *Server) ipver(addr net.Addr) {
 	}
 }
 
-func (a *Server) bind() (conn *net.UDPConn, err error) {
-	if !a.NotMulticast && a.iface.Flags&net.FlagMulticast == net.FlagMulticast {
-		gaddr, err := a.groupAddr()
-		if err != nil {
-			return nil, e.Forward(err)
-		}
-		conn, err = net.ListenMulticastUDP(a.Proto(), a.iface, gaddr)
-		if err != nil {
-			return nil, e.New(err)
+// bind creates the socket that joins the group gaddr in the interface, or
+// its source-specific groups if McSources is set. If gaddr is nil the socket listens in all addresses.
+func (a *Server) bind(iface *net.Interface, gaddr *net.UDPAddr) (conn *net.UDPConn, err error) {
+	if gaddr != nil {
+		if len(a.McSources) > 0 {
+			conn, err = a.listenSources(a.Proto(), iface, gaddr)
+			if err != nil {
+				return nil, e.Forward(err)
+			}
+		} else {
+			conn, err = net.ListenMulticastUDP(a.Proto(), iface, gaddr)
+			if err != nil {
+				return nil, e.New(err)
+			}
 		}
 	} else {
-		server, err := net.ResolveUDPAddr(a.Proto(), ":"+a.Port)
-		if err != nil {
-			return nil, e.New(err)
-		}
-		conn, err = net.ListenUDP(a.Proto(), server)
+		lc := net.ListenConfig{Control: reuseAddr}
+		pc, err := lc.ListenPacket(gocontext.Background(), a.Proto(), ":"+a.Port)
 		if err != nil {
 			return nil, e.New(err)
 		}
+		conn = pc.(*net.UDPConn)
+	}
+	if !a.DualStack {
+		a.ipver(conn.LocalAddr())
 	}
-	a.ipver(conn.LocalAddr())
 	_, a.Port, err = utilNet.SplitHostPort(conn.LocalAddr().String())
 	if err != nil {
 		return nil, e.Forward(err)
@@ -353,9 +908,9 @@ func (a *Server) bind() (conn *net.UDPConn, err error) {
 	return
 }
 
-func (a *Server) haveIpv6() (bool, error) {
+func (a *Server) haveIpv6(iface *net.Interface) (bool, error) {
 	ipv4 := false
-	addrs, err := a.iface.Addrs()
+	addrs, err := iface.Addrs()
 	if err != nil {
 		return false, e.New(err)
 	}
@@ -377,8 +932,8 @@ func (a *Server) haveIpv6() (bool, error) {
 	return false, e.New("no valid ip address")
 }
 
-func (a *Server) groupAddr() (*net.UDPAddr, error) {
-	ipv6, err := a.haveIpv6()
+func (a *Server) groupAddr(iface *net.Interface) (*net.UDPAddr, error) {
+	ipv6, err := a.haveIpv6(iface)
 	if err != nil {
 		return nil, e.Forward(err)
 	}
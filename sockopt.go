@@ -0,0 +1,25 @@
+// Copyright 2015 Felipe A. Cavani. All rights reserved.
+// Use of this source code is governed by the Apache License 2.0
+// license that can be found in the LICENSE file.
+
+//go:build !windows
+// +build !windows
+
+package discover
+
+import (
+	"syscall"
+)
+
+// reuseAddr lets the broadcast socket share the port with the multicast
+// sockets of the other interfaces.
+func reuseAddr(network, address string, c syscall.RawConn) error {
+	var err error
+	er := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	})
+	if er != nil {
+		return er
+	}
+	return err
+}
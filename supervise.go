@@ -0,0 +1,188 @@
+// Copyright 2015 Felipe A. Cavani. All rights reserved.
+// Use of this source code is governed by the Apache License 2.0
+// license that can be found in the LICENSE file.
+
+package discover
+
+import (
+	"crypto/rsa"
+	"time"
+
+	"github.com/fcavani/e"
+	"github.com/fcavani/log"
+)
+
+// State is the state of the client session with the server.
+type State uint8
+
+const (
+	// Discovering means that the client is looking for the server.
+	Discovering State = iota
+	// Connected means that the client has a session with the server.
+	Connected
+	// Degraded means that the session is alive but the last keepalives failed.
+	Degraded
+	// Lost means that the session was lost.
+	Lost
+)
+
+func (s State) String() string {
+	switch s {
+	case Discovering:
+		return "discovering"
+	case Connected:
+		return "connected"
+	case Degraded:
+		return "degraded"
+	case Lost:
+		return "lost"
+	default:
+		return "invalid"
+	}
+}
+
+// ServerInfo identifies a server.
+type ServerInfo struct {
+	// Name is the server name
+	Name string
+	// Key is the server public key
+	Key *rsa.PublicKey
+}
+
+// superviseBackoff is used by the supervisor if the client doesn't have one.
+var superviseBackoff = &ExponentialBackoff{
+	Base: time.Second,
+	Max:  time.Minute,
+}
+
+// State returns the current state of the client.
+func (c *Client) State() State {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	return c.state
+}
+
+func (c *Client) setState(state State) {
+	log.ProtoLevel().Tag("client", "discover").Printf("Client state: %v", state)
+	c.lck.Lock()
+	c.state = state
+	c.lck.Unlock()
+	if c.OnState != nil {
+		c.OnState(state)
+	}
+}
+
+// lost is called when the session with the server is lost. If the client
+// is supervised it starts to discover the server again.
+func (c *Client) lost(successor string) {
+	c.setState(Lost)
+	if !c.Supervise {
+		return
+	}
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	select {
+	case <-c.closed:
+		return
+	default:
+	}
+	c.wg.Add(1)
+	go c.supervise(successor)
+}
+
+// supervise discovers the server again, with backoff between the attempts,
+// until it succeeds or the client is closed.
+func (c *Client) supervise(successor string) {
+	defer c.wg.Done()
+	backoff := c.Backoff
+	if backoff == nil {
+		backoff = superviseBackoff
+	}
+	var wait time.Duration
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-c.closed:
+			return
+		default:
+		}
+		c.setState(Discovering)
+		_, err := c.rediscover(successor)
+		if err == nil {
+			return
+		}
+		log.Tag("client", "discover").Errorf("Discover the server again failed: %v", err)
+		c.setState(Lost)
+		successor = ""
+		wait = backoff.Next(attempt, wait)
+		select {
+		case <-c.closed:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// rediscover closes the old connection and tries the successor, if any,
+// and then the current server and the other known servers.
+func (c *Client) rediscover(successor string) (*Response, error) {
+	c.lck.Lock()
+	conn, replies := c.conn, c.replies
+	c.lck.Unlock()
+	c.closeConn(conn)
+	// Wait recv to finish before change the server.
+	for range replies {
+	}
+
+	servers := []ServerInfo{{Name: c.ServerName, Key: c.ServerKey}}
+	for _, s := range c.Servers {
+		if s.Name != c.ServerName {
+			servers = append(servers, s)
+		}
+	}
+
+	// The successor may be any of the known servers.
+	for _, s := range servers {
+		if successor == "" {
+			break
+		}
+		c.ServerName = s.Name
+		c.ServerKey = s.Key
+		resp, err := c.unicast(successor)
+		if e.Equal(err, ErrClientClosed) {
+			return nil, e.Forward(err)
+		} else if err != nil {
+			log.Tag("client", "discover").Errorf("Can't contact the successor %v as %v: %v", successor, s.Name, err)
+			continue
+		}
+		return resp, nil
+	}
+
+	for _, s := range servers {
+		c.ServerName = s.Name
+		c.ServerKey = s.Key
+		resp, err := c.getAddr()
+		if e.Equal(err, ErrClientClosed) {
+			return nil, e.Forward(err)
+		} else if err != nil {
+			log.Tag("client", "discover").Errorf("Can't find the server %v: %v", s.Name, err)
+			continue
+		}
+		return resp, nil
+	}
+	return nil, e.New("can't find any server")
+}
+
+// unicast contacts the server directly in addr.
+func (c *Client) unicast(addr string) (*Response, error) {
+	conn, dst, err := c.dial(addr)
+	if err != nil {
+		return nil, e.Forward(err)
+	}
+	resp, err := c.handshake(conn, dst, nil)
+	if err != nil {
+		c.closeConn(conn)
+		return nil, e.Forward(err)
+	}
+	c.start(conn, dst, resp)
+	return resp, nil
+}